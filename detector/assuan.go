@@ -0,0 +1,262 @@
+package detector
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	// https://www.gnupg.org/documentation/manuals/gnupg/Agent-Protocol.html
+	ASSUAN_SIGKEY     = "SIGKEY"
+	ASSUAN_SETKEY     = "SETKEY"
+	ASSUAN_SETKEYDESC = "SETKEYDESC"
+	ASSUAN_PKSIGN     = "PKSIGN"
+	ASSUAN_PKDECRYPT  = "PKDECRYPT"
+	ASSUAN_PKAUTH     = "PKAUTH"
+	ASSUAN_OK         = "OK"
+	ASSUAN_ERR        = "ERR"
+	ASSUAN_INQUIRE    = "INQUIRE"
+
+	// Sent by gpg-agent to clients that asked for it with "OPTION allow-pinentry-notify", which gpg does
+	ASSUAN_PINENTRY_LAUNCHED = "PINENTRY_LAUNCHED"
+)
+
+// How long gpg-agent is given to launch pinentry for a card operation, before the card is assumed to wait for a touch
+const ASSUAN_PINENTRY_GRACE = 200 * time.Millisecond
+
+// assuanOperations tells what card operations are for, signatures are told apart by the capabilities of the key
+var assuanOperations = map[string]notifier.Operation{
+	ASSUAN_PKSIGN:    notifier.OPERATION_UNKNOWN,
+	ASSUAN_PKDECRYPT: notifier.OPERATION_DECRYPT,
+	ASSUAN_PKAUTH:    notifier.OPERATION_AUTHENTICATE,
+}
+
+// WatchGPGAgent proxies the gpg-agent sockets of a home, and reports a wait for every operation on a key stored on a card,
+// including operations coming from other hosts through the extra socket forwarded to them
+func WatchGPGAgent(home GPGHome, keys *ShadowedKeys, keyring *GPGKeyring, policies *CardTouchPolicies, waits *GPGWaits, exits *sync.Map) {
+	socketFile := home.findAgentSocket("agent-socket", "S.gpg-agent")
+	if socketFile == "" {
+		log.Errorf("Cannot watch gpg-agent of '%v'. gpgconf --list-dirs agent-socket didn't help, and $XDG_RUNTIME_DIR is not defined.", home)
+		return
+	}
+
+	proxySocket("gpg-agent", socketFile, home.exitKey("detector/gpg_agent"), exits, proxyAssuan(waits, keys, keyring, policies))
+
+	extraSocketFile := home.findAgentSocket("agent-extra-socket", "S.gpg-agent.extra")
+	if extraSocketFile == "" {
+		log.Debugf("Not watching gpg-agent extra socket of '%v', gpgconf --list-dirs agent-extra-socket didn't help", home)
+		return
+	}
+	proxySocket("gpg-agent extra", extraSocketFile, home.exitKey("detector/gpg_agent_extra"), exits, proxyAssuan(waits, keys, keyring, policies))
+}
+
+// WatchForwardedGPGAgent proxies a gpg-agent socket forwarded from another host, where the card actually is,
+// and reports a wait for every operation going through it
+func WatchForwardedGPGAgent(home GPGHome, keyring *GPGKeyring, waits *GPGWaits, exits *sync.Map) {
+	socketFile := home.findAgentSocket("agent-socket", "S.gpg-agent")
+	if socketFile == "" {
+		log.Errorf("Cannot watch forwarded gpg-agent of '%v'. gpgconf --list-dirs agent-socket didn't help, and $XDG_RUNTIME_DIR is not defined.", home)
+		return
+	}
+
+	// Whether a key is on a card is only known on the other host, every operation is assumed to need a touch
+	proxySocket("forwarded gpg-agent", socketFile, home.exitKey("detector/gpg_agent_forwarded"), exits, proxyAssuan(waits, nil, keyring, nil))
+}
+
+// proxyAssuan follows the conversation of every client with the agent,
+// when keys are not known, all keys are assumed to be on a card
+func proxyAssuan(waits *GPGWaits, keys *ShadowedKeys, keyring *GPGKeyring, policies *CardTouchPolicies) func(client net.Conn, agent net.Conn) {
+	return func(proxyConnection, originalConnection net.Conn) {
+		session := &assuanSession{waits: waits, keys: keys, keyring: keyring, policies: policies}
+		go session.proxyCommands(proxyConnection, originalConnection)
+		go session.proxyResponses(originalConnection, proxyConnection)
+	}
+}
+
+// assuanSession follows a single connection to the agent, commands and responses are read concurrently
+type assuanSession struct {
+	mutex     sync.Mutex
+	waits     *GPGWaits
+	keys      *ShadowedKeys
+	keyring   *GPGKeyring
+	policies  *CardTouchPolicies
+	keygrip   string
+	waiting   bool
+	operation notifier.Operation
+	card      string
+
+	// The wait of the operation is announced once it is known whether it waits for the PIN or for a touch
+	announce      func(state notifier.State)
+	announceTimer *time.Timer
+}
+
+// proxyCommands forwards what the client sends, and starts a wait when it issues a card operation
+func (s *assuanSession) proxyCommands(client net.Conn, agent net.Conn) {
+	defer s.close(client, agent)
+
+	proxyAssuanLines(client, agent, func(line string) {
+		command, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case ASSUAN_SIGKEY, ASSUAN_SETKEY:
+			s.mutex.Lock()
+			s.keygrip = strings.ToUpper(strings.TrimSpace(args))
+			s.mutex.Unlock()
+		case ASSUAN_SETKEYDESC:
+			log.Debugf("gpg-agent is asked for key '%v'", assuanUnescape(strings.ReplaceAll(args, "+", " ")))
+		case ASSUAN_PKSIGN, ASSUAN_PKDECRYPT, ASSUAN_PKAUTH:
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.keys != nil && !s.keys.isShadowed(s.keygrip) {
+				log.Debugf("gpg-agent is asked for %v with key '%v' which is not on a card", command, s.keygrip)
+				return
+			}
+			operation, key := s.keyring.describe(s.keygrip, assuanOperations[strings.ToUpper(command)])
+			card := s.keys.cardSerial(s.keygrip)
+			if !s.policies.needsTouch(card, operation) {
+				log.Debugf("gpg-agent is asked for %v with key '%v' which does not need a touch", command, s.keygrip)
+				return
+			}
+			if cachedUntil := s.policies.cachedUntil(card, operation); !cachedUntil.IsZero() {
+				log.Debugf("gpg-agent is asked for %v with key '%v' whose touch is cached for %v", command, s.keygrip, time.Until(cachedUntil).Round(time.Second))
+				return
+			}
+			if !s.waiting {
+				s.waiting = true
+				s.operation = operation
+				s.card = card
+
+				// Without the key files, the card is on another host
+				var device *notifier.Device
+				if s.keys != nil {
+					device = inventory.findCard(card)
+				}
+				event := notifier.Event{Operation: operation, GPGKey: key, TouchPolicy: s.policies.of(card, operation), CardSerial: card, Device: device}
+				s.announce = func(state notifier.State) {
+					event.State = state
+					s.waits.start(event)
+				}
+				var timer *time.Timer
+				timer = time.AfterFunc(ASSUAN_PINENTRY_GRACE, func() {
+					s.mutex.Lock()
+					defer s.mutex.Unlock()
+					if s.announceTimer == timer {
+						s.announceWait(gpgWaitState())
+					}
+				})
+				s.announceTimer = timer
+			}
+		}
+	})
+}
+
+// proxyResponses forwards what the agent sends, and stops a wait when the card operation completes
+func (s *assuanSession) proxyResponses(agent net.Conn, client net.Conn) {
+	defer s.close(agent, client)
+
+	proxyAssuanLines(agent, client, func(line string) {
+		status, args, _ := strings.Cut(line, " ")
+		switch status {
+		case ASSUAN_OK, ASSUAN_ERR:
+			s.stopWaiting(status == ASSUAN_OK)
+		case ASSUAN_INQUIRE:
+			fields := strings.Fields(args)
+			if len(fields) > 1 && fields[0] == ASSUAN_PINENTRY_LAUNCHED {
+				pid, _ := strconv.Atoi(fields[1])
+				s.waitForPinentry(pid)
+			}
+		}
+	})
+}
+
+// waitForPinentry reports that the card waits for the PIN to be typed, until pinentry is closed
+func (s *assuanSession) waitForPinentry(pid int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.waiting || pid <= 0 {
+		return
+	}
+	s.announceWait(notifier.STATE_PIN)
+	s.waits.pinentryLaunched(pid)
+}
+
+// stopWaiting ends the wait for a card operation, which was touched when it completed successfully
+func (s *assuanSession) stopWaiting(touched bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.waiting {
+		return
+	}
+	s.waiting = false
+
+	var cachedUntil time.Time
+	if touched {
+		cachedUntil = s.policies.touched(s.card, s.operation)
+	}
+	if s.announce != nil {
+		// The operation completed before it was known to wait for anything
+		s.announceTimer.Stop()
+		s.announce = nil
+		return
+	}
+	s.waits.stop(cachedUntil)
+}
+
+// announceWait starts the wait of the current operation, unless it was already started
+func (s *assuanSession) announceWait(state notifier.State) {
+	if s.announce == nil {
+		return
+	}
+	s.announceTimer.Stop()
+	s.announce(state)
+	s.announce = nil
+}
+
+func (s *assuanSession) close(reader net.Conn, writer net.Conn) {
+	reader.Close()
+	writer.Close()
+	s.stopWaiting(false)
+}
+
+// proxyAssuanLines forwards data line by line, letting onLine inspect each line before it is sent further
+func proxyAssuanLines(reader io.Reader, writer io.Writer, onLine func(line string)) {
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] == '\n' {
+				onLine(strings.TrimRight(string(line), "\r\n"))
+			}
+			if _, err := writer.Write(line); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// assuanUnescape decodes the percent-escaping of Assuan parameters
+func assuanUnescape(value string) string {
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if decoded, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				result.WriteByte(byte(decoded))
+				i += 2
+				continue
+			}
+		}
+		result.WriteByte(value[i])
+	}
+	return result.String()
+}
@@ -0,0 +1,94 @@
+package detector
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// The application identifier of an OpenPGP card: the OpenPGP RID, the version, the manufacturer, the serial number and RFU bytes.
+// https://gnupg.org/ftp/specs/OpenPGP-smart-card-application-3.4.pdf, 4.2.1
+var openPGPAIDPattern = regexp.MustCompile(`D276000124[0-9A-Fa-f]{22}`)
+
+const (
+	OPENPGP_MANUFACTURER_YUBICO = "0006"
+
+	// The status line scdaemon sends the application identifier of the card with
+	OPENPGP_STATUS_SERIALNO = "SERIALNO"
+)
+
+// findOpenPGPAID finds the application identifier of the card a shadowed private key is stored on,
+// which is part of its shadow info, e.g. (shadowed t1-v1 (#D2760001240103040006123456780000# OPENPGP.1))
+func findOpenPGPAID(data string) string {
+	return strings.ToUpper(openPGPAIDPattern.FindString(data))
+}
+
+// cardSerial extracts the serial number of a card from its application identifier, as the manufacturer tells it.
+// YubiKeys since 5 put their serial number there in decimal digits, older ones in hex, both are told in decimal like on the USB device.
+func cardSerial(aid string) string {
+	if len(aid) != 32 {
+		return ""
+	}
+	manufacturer, serial := aid[16:20], aid[20:28]
+	if manufacturer != OPENPGP_MANUFACTURER_YUBICO {
+		return serial
+	}
+	if _, err := strconv.ParseUint(serial, 10, 32); err == nil {
+		return strings.TrimLeft(serial, "0")
+	}
+	if decimal, err := strconv.ParseUint(serial, 16, 32); err == nil {
+		return strconv.FormatUint(decimal, 10)
+	}
+	return serial
+}
+
+// readCardSerial asks scdaemon for the serial number of the card that is currently inserted
+func readCardSerial(agent *GPGAgent) string {
+	var serial string
+	err := agent.send("SCD SERIALNO", 0, func(status, args string) error {
+		if status == OPENPGP_STATUS_SERIALNO {
+			aid, _, _ := strings.Cut(args, " ")
+			serial = cardSerial(aid)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("Cannot read the serial number of the card: %v", err)
+	}
+	return serial
+}
+
+// findCard finds an interface of the connected key that is the card with the given serial number.
+// Most keys do not tell their serial number over USB, then the only such key with a smart card interface is assumed to be the card.
+func (i *keyInventory) findCard(serial string) *notifier.Device {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var cards []string
+	for identity, key := range i.keys {
+		if serial != "" && strings.TrimLeft(key.Serial, "0") == serial {
+			return i.anyInterface(identity)
+		}
+		if key.Serial == "" && slices.Contains(key.Interfaces, notifier.INTERFACE_CCID) {
+			cards = append(cards, identity)
+		}
+	}
+	if len(cards) == 1 {
+		return i.anyInterface(cards[0])
+	}
+	return nil
+}
+
+func (i *keyInventory) anyInterface(identity string) *notifier.Device {
+	key := i.keys[identity]
+	if len(key.HidrawPaths) == 0 {
+		return nil
+	}
+	device := i.interfaces[identity][key.HidrawPaths[0]]
+	return &device
+}
@@ -0,0 +1,120 @@
+package detector
+
+import (
+	"errors"
+)
+
+// Just enough of CBOR (RFC 8949) to look at the shape of CTAP2 responses,
+// values are never decoded, only their major types are reported.
+const (
+	CBOR_MAJOR_UINT   = 0
+	CBOR_MAJOR_NEGINT = 1
+	CBOR_MAJOR_BYTES  = 2
+	CBOR_MAJOR_TEXT   = 3
+	CBOR_MAJOR_ARRAY  = 4
+	CBOR_MAJOR_MAP    = 5
+	CBOR_MAJOR_TAG    = 6
+	CBOR_MAJOR_SIMPLE = 7
+	CBOR_MAX_NESTING  = 16
+)
+
+var errCborTruncated = errors.New("truncated CBOR item")
+var errCborUnsupported = errors.New("unsupported CBOR item")
+
+// cborHeader decodes the initial byte and the argument of a CBOR item
+func cborHeader(data []byte) (major byte, arg uint64, size int, err error) {
+	if len(data) < 1 {
+		return 0, 0, 0, errCborTruncated
+	}
+	major = data[0] >> 5
+	info := data[0] & 0b00011111
+
+	switch {
+	case info < 24:
+		return major, uint64(info), 1, nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < 1+n {
+			return 0, 0, 0, errCborTruncated
+		}
+		for _, b := range data[1 : 1+n] {
+			arg = (arg << 8) | uint64(b)
+		}
+		return major, arg, 1 + n, nil
+	}
+
+	// Indefinite lengths are not allowed in CTAP2 canonical encoding
+	return 0, 0, 0, errCborUnsupported
+}
+
+// cborSkip returns the encoded size of the first CBOR item in data
+func cborSkip(data []byte, depth int) (int, error) {
+	if depth > CBOR_MAX_NESTING {
+		return 0, errCborUnsupported
+	}
+
+	major, arg, size, err := cborHeader(data)
+	if err != nil {
+		return 0, err
+	}
+
+	items := uint64(0)
+	switch major {
+	case CBOR_MAJOR_BYTES, CBOR_MAJOR_TEXT:
+		if uint64(len(data)-size) < arg {
+			return 0, errCborTruncated
+		}
+		return size + int(arg), nil
+	case CBOR_MAJOR_ARRAY:
+		items = arg
+	case CBOR_MAJOR_MAP:
+		items = 2 * arg
+	case CBOR_MAJOR_TAG:
+		items = 1
+	}
+
+	for i := uint64(0); i < items; i++ {
+		n, err := cborSkip(data[size:], depth+1)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// cborMapShape returns the major type of each value of a CBOR map keyed by unsigned integers,
+// which is how every CTAP2 command response is encoded
+func cborMapShape(data []byte) (map[uint64]byte, error) {
+	major, entries, size, err := cborHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if major != CBOR_MAJOR_MAP {
+		return nil, errCborUnsupported
+	}
+
+	shape := make(map[uint64]byte)
+	for i := uint64(0); i < entries; i++ {
+		keyMajor, key, n, err := cborHeader(data[size:])
+		if err != nil {
+			return nil, err
+		}
+		if keyMajor != CBOR_MAJOR_UINT {
+			return nil, errCborUnsupported
+		}
+		size += n
+
+		valueMajor, _, _, err := cborHeader(data[size:])
+		if err != nil {
+			return nil, err
+		}
+		if n, err = cborSkip(data[size:], 0); err != nil {
+			return nil, err
+		}
+		size += n
+
+		shape[key] = valueMajor
+	}
+	return shape, nil
+}
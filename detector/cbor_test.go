@@ -0,0 +1,78 @@
+package detector
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCborMapShape(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		shape map[uint64]byte
+		err   error
+	}{
+		{
+			name:  "makeCredential response",
+			data:  makeCredentialResponse[1:],
+			shape: map[uint64]byte{1: CBOR_MAJOR_TEXT, 2: CBOR_MAJOR_BYTES, 3: CBOR_MAJOR_MAP},
+		},
+		{
+			name:  "getAssertion response",
+			data:  getAssertionResponse[1:],
+			shape: map[uint64]byte{1: CBOR_MAJOR_MAP, 2: CBOR_MAJOR_BYTES, 3: CBOR_MAJOR_BYTES},
+		},
+		{
+			name:  "nested values",
+			data:  []byte{0xa2, 0x01, 0x82, 0x01, 0xa1, 0x02, 0x03, 0x18, 0x20, 0xf5},
+			shape: map[uint64]byte{1: CBOR_MAJOR_ARRAY, 32: CBOR_MAJOR_SIMPLE},
+		},
+		{
+			name: "not a map",
+			data: []byte{0x82, 0x01, 0x02},
+			err:  errCborUnsupported,
+		},
+		{
+			name: "text key",
+			data: []byte{0xa1, 0x61, 'a', 0x01},
+			err:  errCborUnsupported,
+		},
+		{
+			name: "indefinite length",
+			data: []byte{0xa1, 0x01, 0x5f, 0x41, 0x00, 0xff},
+			err:  errCborUnsupported,
+		},
+		{
+			name: "truncated byte string",
+			data: []byte{0xa1, 0x01, 0x58, 0x20, 0x00},
+			err:  errCborTruncated,
+		},
+		{
+			name: "missing value",
+			data: []byte{0xa1, 0x01},
+			err:  errCborTruncated,
+		},
+		{
+			name: "too deeply nested",
+			data: append([]byte{0xa1, 0x01}, append(bytes.Repeat([]byte{0x81}, CBOR_MAX_NESTING+2), 0x00)...),
+			err:  errCborUnsupported,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shape, err := cborMapShape(test.data)
+			if err != test.err {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if len(shape) != len(test.shape) {
+				t.Fatalf("Expected shape %v, got %v", test.shape, shape)
+			}
+			for key, major := range test.shape {
+				if shape[key] != major {
+					t.Errorf("Expected shape %v, got %v", test.shape, shape)
+				}
+			}
+		})
+	}
+}
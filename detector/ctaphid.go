@@ -0,0 +1,190 @@
+package detector
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// https://fidoalliance.org/specs/fido-v2.1-ps-20210615/fido-client-to-authenticator-protocol-v2.1-ps-20210615.html#usb-message-and-packet-structure
+	CTAPHID_INIT_HEADER_SIZE = 7
+	CTAPHID_CONT_HEADER_SIZE = 5
+	CTAPHID_DEFAULT_REPORT   = 64
+	CTAPHID_MAX_SEQ          = 0x7f
+
+	// https://www.usb.org/document-library/device-class-definition-hid-111, 6.2.2 Report Descriptor
+	HID_ITEM_TYPE_MAIN              = 0
+	HID_MAIN_ITEM_TAG_INPUT         = 8
+	HID_GLOBAL_ITEM_TAG_REPORT_SIZE = 7
+	HID_GLOBAL_ITEM_TAG_REPORT_CNT  = 9
+	HID_ITEM_LONG                   = 0xfe
+)
+
+// ctaphidFrame is a complete CTAPHID message received from the authenticator
+type ctaphidFrame struct {
+	channel uint32
+	command byte
+	data    []byte
+}
+
+// ctaphidMessage is a message being reassembled from an initialization packet and its continuation packets
+type ctaphidMessage struct {
+	command byte
+	length  int
+	nextSeq byte
+	data    []byte
+}
+
+func (m *ctaphidMessage) append(data []byte) {
+	remaining := m.length - len(m.data)
+	if len(data) > remaining {
+		data = data[:remaining]
+	}
+	m.data = append(m.data, data...)
+}
+
+func (m *ctaphidMessage) complete() bool {
+	return len(m.data) >= m.length
+}
+
+// ctaphidFramer reassembles input reports into CTAPHID messages, independently for each channel
+type ctaphidFramer struct {
+	reportSize int
+	pending    map[uint32]*ctaphidMessage
+}
+
+func newCtaphidFramer(reportSize int) *ctaphidFramer {
+	return &ctaphidFramer{reportSize: reportSize, pending: make(map[uint32]*ctaphidMessage)}
+}
+
+// push consumes a single input report, and returns a frame once the message it belongs to is complete
+func (f *ctaphidFramer) push(report []byte) (*ctaphidFrame, error) {
+	if len(report) > f.reportSize {
+		report = report[:f.reportSize]
+	}
+	if len(report) < CTAPHID_CONT_HEADER_SIZE {
+		return nil, fmt.Errorf("report of %v bytes is too short", len(report))
+	}
+
+	channel := binary.BigEndian.Uint32(report[0:4])
+
+	if report[4]&TYPE_INIT != 0 {
+		if len(report) < CTAPHID_INIT_HEADER_SIZE {
+			return nil, fmt.Errorf("initialization packet of %v bytes is too short", len(report))
+		}
+
+		// A new initialization packet aborts whatever was in progress on the channel
+		delete(f.pending, channel)
+
+		message := &ctaphidMessage{
+			command: report[4],
+			length:  int(binary.BigEndian.Uint16(report[5:7])),
+		}
+		message.append(report[CTAPHID_INIT_HEADER_SIZE:])
+		if !message.complete() {
+			f.pending[channel] = message
+			return nil, nil
+		}
+		return &ctaphidFrame{channel: channel, command: message.command, data: message.data}, nil
+	}
+
+	message, ok := f.pending[channel]
+	if !ok {
+		return nil, fmt.Errorf("continuation packet on channel %08x without initialization packet", channel)
+	}
+	if message.nextSeq > CTAPHID_MAX_SEQ {
+		delete(f.pending, channel)
+		return nil, fmt.Errorf("message on channel %08x exceeds the maximum number of continuation packets", channel)
+	}
+	if seq := report[4]; seq != message.nextSeq {
+		delete(f.pending, channel)
+		return nil, fmt.Errorf("continuation packet on channel %08x out of order: expected %v, got %v", channel, message.nextSeq, seq)
+	}
+
+	message.nextSeq++
+	message.append(report[CTAPHID_CONT_HEADER_SIZE:])
+	if !message.complete() {
+		return nil, nil
+	}
+	delete(f.pending, channel)
+	return &ctaphidFrame{channel: channel, command: message.command, data: message.data}, nil
+}
+
+// statusWord returns the ISO 7816 status word that ends every U2F response
+func (f *ctaphidFrame) statusWord() int {
+	if len(f.data) < 2 {
+		return -1
+	}
+	return int(binary.BigEndian.Uint16(f.data[len(f.data)-2:]))
+}
+
+// parseFidoDescriptor tells whether a HID report descriptor describes a CTAPHID interface,
+// and if so, what is the size of its input reports
+func parseFidoDescriptor(descriptor []byte) (bool, int) {
+	usagePage := 0
+	reportSize := 0
+	reportCount := 0
+	isFido := false
+	hasU2F := false
+	inputBits := 0
+
+	for i := 0; i < len(descriptor); {
+		prefix := descriptor[i]
+		if prefix == HID_ITEM_LONG {
+			if i+1 >= len(descriptor) {
+				break
+			}
+			i += 3 + int(descriptor[i+1])
+			continue
+		}
+
+		tag := (prefix & 0b11110000) >> 4
+		typ := (prefix & 0b00001100) >> 2
+		size := int(prefix & 0b00000011)
+		if size == 3 {
+			size = 4
+		}
+		if i+1+size > len(descriptor) {
+			break
+		}
+
+		value := 0
+		for b := size; b > 0; b-- {
+			value = value<<8 | int(descriptor[i+b])
+		}
+
+		switch typ {
+		case HID_ITEM_TYPE_GLOBAL:
+			switch tag {
+			case HID_GLOBAL_ITEM_TAG_USAGE_PAGE:
+				usagePage = value
+				if value == FIDO_USAGE_PAGE {
+					isFido = true
+				}
+			case HID_GLOBAL_ITEM_TAG_REPORT_SIZE:
+				reportSize = value
+			case HID_GLOBAL_ITEM_TAG_REPORT_CNT:
+				reportCount = value
+			}
+		case HID_ITEM_TYPE_LOCAL:
+			if tag == HID_LOCAL_ITEM_TAG_USAGE && usagePage == FIDO_USAGE_PAGE && value == FIDO_USAGE_CTAPHID {
+				hasU2F = true
+			}
+		case HID_ITEM_TYPE_MAIN:
+			if tag == HID_MAIN_ITEM_TAG_INPUT && usagePage == FIDO_USAGE_PAGE {
+				inputBits += reportSize * reportCount
+			}
+		}
+
+		i += size + 1
+	}
+
+	if !isFido || !hasU2F {
+		return false, 0
+	}
+
+	if inputBits == 0 {
+		return true, CTAPHID_DEFAULT_REPORT
+	}
+	return true, inputBits / 8
+}
@@ -0,0 +1,98 @@
+package detector
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCtaphidFramerPush(t *testing.T) {
+	// The largest message that fits in an initialization packet and 128 continuation packets
+	largest := bytes.Repeat([]byte{0x42}, CTAPHID_DEFAULT_REPORT-CTAPHID_INIT_HEADER_SIZE+(CTAPHID_MAX_SEQ+1)*(CTAPHID_DEFAULT_REPORT-CTAPHID_CONT_HEADER_SIZE))
+	multi := bytes.Repeat([]byte{0x01}, 200)
+
+	interleaved := func() [][]byte {
+		a := ctaphidReports(channelA, CTAPHID_CBOR, multi)
+		b := ctaphidReports(channelB, CTAPHID_MSG, multi)
+		var reports [][]byte
+		for i := range a {
+			reports = append(reports, a[i], b[i])
+		}
+		return reports
+	}
+
+	outOfOrder := func() [][]byte {
+		reports := ctaphidReports(channelA, CTAPHID_CBOR, multi)
+		return [][]byte{reports[0], reports[2], reports[1]}
+	}
+
+	tests := []struct {
+		name    string
+		reports [][]byte
+		frames  []ctaphidFrame
+		errors  int
+	}{
+		{
+			name:    "single packet",
+			reports: ctaphidReports(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded),
+			frames:  []ctaphidFrame{{channel: channelA, command: CTAPHID_KEEPALIVE, data: keepaliveUpNeeded}},
+		},
+		{
+			name:    "multi packet",
+			reports: ctaphidReports(channelA, CTAPHID_CBOR, multi),
+			frames:  []ctaphidFrame{{channel: channelA, command: CTAPHID_CBOR, data: multi}},
+		},
+		{
+			name:    "interleaved channels",
+			reports: interleaved(),
+			frames: []ctaphidFrame{
+				{channel: channelA, command: CTAPHID_CBOR, data: multi},
+				{channel: channelB, command: CTAPHID_MSG, data: multi},
+			},
+		},
+		{
+			name:    "out of order",
+			reports: outOfOrder(),
+			errors:  2,
+		},
+		{
+			name:    "continuation without initialization",
+			reports: ctaphidReports(channelA, CTAPHID_CBOR, multi)[1:],
+			errors:  3,
+		},
+		{
+			name:    "largest message",
+			reports: ctaphidReports(channelA, CTAPHID_CBOR, largest),
+			frames:  []ctaphidFrame{{channel: channelA, command: CTAPHID_CBOR, data: largest}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			framer := newCtaphidFramer(CTAPHID_DEFAULT_REPORT)
+			var frames []ctaphidFrame
+			errors := 0
+			for _, report := range test.reports {
+				frame, err := framer.push(report)
+				if err != nil {
+					errors++
+				} else if frame != nil {
+					frames = append(frames, *frame)
+				}
+			}
+
+			if errors != test.errors {
+				t.Errorf("Expected %v errors, got %v", test.errors, errors)
+			}
+			if len(frames) != len(test.frames) {
+				t.Fatalf("Expected %v frames, got %v", len(test.frames), len(frames))
+			}
+			for i, want := range test.frames {
+				got := frames[i]
+				if got.channel != want.channel || got.command != want.command || !bytes.Equal(got.data, want.data) {
+					t.Errorf("Expected frame %08x/%#x with %v bytes, got %08x/%#x with %v bytes",
+						want.channel, want.command, len(want.data), got.channel, got.command, len(got.data))
+				}
+			}
+		})
+	}
+}
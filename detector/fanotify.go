@@ -0,0 +1,117 @@
+package detector
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// watchGPGFanotify watches for opened key files with fanotify, which, unlike inotify, tells which process opened the file.
+// Listening to open events requires CAP_SYS_ADMIN, an error is returned when the watch cannot be established or breaks.
+func watchGPGFanotify(keys *ShadowedKeys, requestGPGCheck chan GPGCheckRequest, ignoredProcesses []string) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC, unix.O_RDONLY|unix.O_CLOEXEC|unix.O_LARGEFILE)
+	if err != nil {
+		return fmt.Errorf("cannot initialize fanotify: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// Unlike inotify watches, marks can be flushed at once and established again
+	mark := func() {
+		if err := unix.FanotifyMark(fd, unix.FAN_MARK_FLUSH, 0, unix.AT_FDCWD, ""); err != nil {
+			log.Errorf("Cannot remove fanotify marks of GPG files: %v", err)
+		}
+		for _, file := range keys.Files() {
+			if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD, unix.FAN_OPEN, unix.AT_FDCWD, file); err != nil {
+				log.Errorf("Failed to establish a fanotify mark on GPG file '%s': %v", file, err)
+				continue
+			}
+			log.Debugf("GPG fanotify watcher is watching '%s'...", file)
+		}
+	}
+
+	changes := keys.subscribe()
+	done := make(chan bool)
+	defer close(done)
+	mark()
+	go func() {
+		for {
+			select {
+			case <-changes:
+				log.Debug("Shadowed private keys changed, recreating the GPG fanotify marks")
+				mark()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	metadataSize := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	self := os.Getpid()
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("cannot read fanotify events: %v", err)
+		}
+
+		for offset := 0; offset+metadataSize <= n; {
+			event := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if event.Vers != unix.FANOTIFY_METADATA_VERSION || int(event.Event_len) < metadataSize {
+				return fmt.Errorf("unsupported fanotify event version %v", event.Vers)
+			}
+			offset += int(event.Event_len)
+
+			if event.Fd < 0 {
+				continue
+			}
+			file, _ := os.Readlink(path.Join("/proc/self/fd", strconv.Itoa(int(event.Fd))))
+			unix.Close(int(event.Fd))
+
+			pid := int(event.Pid)
+			if pid == self {
+				continue
+			}
+			opener, ok := describeProcess(pid)
+			if ok && isIgnoredProcess(pid, opener, ignoredProcesses) {
+				log.Debugf("Ignoring GPG file '%v' opened by %v[%v]", file, opener.Name(), pid)
+				continue
+			}
+
+			keygrip := strings.TrimSuffix(path.Base(file), ".key")
+			request := GPGCheckRequest{Keygrip: keygrip, CardSerial: keys.cardSerial(keygrip)}
+			if processComm(pid) == "gpg-agent" {
+				// The agent opens the key on behalf of one of its clients
+				request.Process = findGPGRequester()
+				if request.Process != nil && isIgnoredProcess(request.Process.PID, *request.Process, ignoredProcesses) {
+					log.Debugf("Ignoring GPG file '%v' opened by gpg-agent for %v[%v]", file, request.Process.Name(), request.Process.PID)
+					continue
+				}
+			} else if ok {
+				request.Process = &opener
+			}
+			select {
+			case requestGPGCheck <- request:
+			default:
+			}
+		}
+	}
+}
+
+// isIgnoredProcess tells whether a process is known by one of the given names, as its kernel name or by its executable
+func isIgnoredProcess(pid int, process notifier.Process, ignoredProcesses []string) bool {
+	return slices.Contains(ignoredProcesses, processComm(pid)) ||
+		slices.Contains(ignoredProcesses, path.Base(process.Executable)) ||
+		slices.Contains(ignoredProcesses, process.Name())
+}
@@ -0,0 +1,102 @@
+package detector
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// DeviceRule matches hidraw devices by their identity, every non-empty field is a glob pattern that must match
+type DeviceRule struct {
+	ID     string // "vvvv:pppp", vendor and product ID in lowercase hex
+	Serial string
+	Name   string // case-insensitive
+	Path   string
+}
+
+// DeviceFilter decides which devices the detectors are allowed to attach to
+type DeviceFilter struct {
+	Include []DeviceRule
+	Exclude []DeviceRule
+}
+
+// ParseDeviceRules parses a comma-separated list of rules,
+// each rule being one or more '&'-separated criteria like "id=1050:0407", "serial=1234*", "name=*nitrokey*" or "path=/dev/hidraw3"
+func ParseDeviceRules(spec string) ([]DeviceRule, error) {
+	var rules []DeviceRule
+	for _, ruleSpec := range strings.Split(spec, ",") {
+		ruleSpec = strings.TrimSpace(ruleSpec)
+		if ruleSpec == "" {
+			continue
+		}
+
+		rule := DeviceRule{}
+		for _, criterion := range strings.Split(ruleSpec, "&") {
+			key, pattern, ok := strings.Cut(strings.TrimSpace(criterion), "=")
+			if !ok || pattern == "" {
+				return nil, fmt.Errorf("invalid criterion '%v' in device rule '%v'", criterion, ruleSpec)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern '%v' in device rule '%v': %v", pattern, ruleSpec, err)
+			}
+
+			switch key {
+			case "id":
+				rule.ID = strings.ToLower(pattern)
+				if !strings.Contains(rule.ID, ":") {
+					rule.ID += ":*"
+				}
+			case "serial":
+				rule.Serial = pattern
+			case "name":
+				rule.Name = strings.ToLower(pattern)
+			case "path":
+				rule.Path = pattern
+			default:
+				return nil, fmt.Errorf("unknown criterion '%v' in device rule '%v'", key, ruleSpec)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r DeviceRule) matches(device notifier.Device) bool {
+	match := func(pattern, value string) bool {
+		if pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(pattern, value)
+		return ok
+	}
+
+	return match(r.ID, fmt.Sprintf("%04x:%04x", device.VendorID, device.ProductID)) &&
+		match(r.Serial, device.Serial) &&
+		match(r.Name, strings.ToLower(device.Name)) &&
+		match(r.Path, device.Path)
+}
+
+func matchesAnyRule(rules []DeviceRule, device notifier.Device) bool {
+	for _, rule := range rules {
+		if rule.matches(device) {
+			return true
+		}
+	}
+	return false
+}
+
+// includes tells whether a device is explicitly matched by an include rule,
+// which lets a detector watch a device it would not pick by itself, e.g. a key of another vendor
+func (f DeviceFilter) includes(device notifier.Device) bool {
+	return matchesAnyRule(f.Include, device) && !matchesAnyRule(f.Exclude, device)
+}
+
+// allows tells whether a device may be watched, when include rules are given only the matching devices are
+func (f DeviceFilter) allows(device notifier.Device) bool {
+	if matchesAnyRule(f.Exclude, device) {
+		return false
+	}
+	return len(f.Include) == 0 || matchesAnyRule(f.Include, device)
+}
@@ -1,27 +1,45 @@
 package detector
 
 import (
-	"sync"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/proglottis/gpgme"
 	"github.com/rjeczalik/notify"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/maximbaz/yubikey-touch-detector/notifier"
 )
 
-// WatchGPG watches for hints that YubiKey is maybe waiting for a touch on a GPG request
-func WatchGPG(filesToWatch []string, requestGPGCheck chan bool) {
+// GPGCheckRequest asks to check whether YubiKey is waiting for a touch, with what is known about the operation
+type GPGCheckRequest struct {
+	Keygrip string
+	Process *notifier.Process
+
+	// CardSerial is the serial number of the card the key is stored on, if known
+	CardSerial string
+}
+
+// WatchGPG watches for hints that YubiKey is maybe waiting for a touch on a GPG request.
+// With fanotify, when permitted, the process that opened a key file is known, and opens by ignored processes are skipped.
+func WatchGPG(keys *ShadowedKeys, requestGPGCheck chan GPGCheckRequest, fanotify bool, ignoredProcesses []string) {
+	if fanotify {
+		err := watchGPGFanotify(keys, requestGPGCheck, ignoredProcesses)
+		log.Warnf("Cannot watch GPG files with fanotify, falling back to inotify: %v", err)
+	}
+
 	// No need for a buffered channel,
 	// we are interested only in the first event, it's ok to skip all subsequent ones
 	events := make(chan notify.EventInfo)
+	changes := keys.subscribe()
 
 	initWatcher := func() {
-		for _, file := range filesToWatch {
-			if err := notify.Watch(file, events, notify.InOpen, notify.InDeleteSelf, notify.InMoveSelf); err != nil {
+		notify.Stop(events)
+		for _, file := range keys.Files() {
+			if err := notify.Watch(file, events, notify.InOpen); err != nil {
 				log.Errorf("Failed to establish a watch on GPG file '%s': %v\n", file, err)
-				return
+				continue
 			}
 			log.Debugf("GPG watcher is watching '%s'...\n", file)
 		}
@@ -30,53 +48,116 @@ func WatchGPG(filesToWatch []string, requestGPGCheck chan bool) {
 	initWatcher()
 	defer notify.Stop(events)
 
-	for event := range events {
-		switch event.Event() {
-		case notify.InOpen:
+	for {
+		select {
+		case <-changes:
+			log.Debug("Shadowed private keys changed, recreating the GPG watcher")
+			initWatcher()
+		case event := <-events:
+			keygrip := strings.TrimSuffix(path.Base(event.Path()), ".key")
 			select {
-			case requestGPGCheck <- true:
+			case requestGPGCheck <- GPGCheckRequest{Keygrip: keygrip, CardSerial: keys.cardSerial(keygrip)}:
 			default:
 			}
-		default:
-			log.Debugf("GPG received file event '%+v', recreating the watcher.", event.Event())
-			notify.Stop(events)
-			time.Sleep(5 * time.Second)
-			initWatcher()
 		}
 	}
 }
 
-// CheckGPGOnRequest checks whether YubiKey is actually waiting for a touch on a GPG request
-func CheckGPGOnRequest(requestGPGCheck chan bool, notifiers *sync.Map, ctx *gpgme.Context) {
-	check := func(response chan error, ctx *gpgme.Context, t *time.Timer) {
-		err := ctx.AssuanSend("LEARN", nil, nil, func(status, args string) error {
+// CheckGPGOnRequest checks whether YubiKey is actually waiting for a touch on a GPG request to an agent,
+// by probing the card and assuming that it waits for a touch when the probe takes longer than usual
+func CheckGPGOnRequest(agent *GPGAgent, probe CardProbe, requestGPGCheck chan GPGCheckRequest, waits *GPGWaits, keyring *GPGKeyring, policies *CardTouchPolicies) {
+	latencies := &probeLatencies{}
+
+	// The card that was inserted the last time it was asked, for requests that do not tell which key they are for
+	serial := readCardSerial(agent)
+
+	check := func(response chan error, t *time.Timer) {
+		start := time.Now()
+		probedSerial := ""
+		err := agent.send(probe.Command, probe.Timeout, func(status, args string) error {
 			log.Debugf("AssuanSend/status: %v, %v", status, args)
+			if status == OPENPGP_STATUS_SERIALNO {
+				aid, _, _ := strings.Cut(args, " ")
+				probedSerial = cardSerial(aid)
+			}
 
 			return nil
 		})
+		latency := time.Since(start)
+		if err == nil {
+			latencies.record(latency)
+			if probedSerial != "" {
+				serial = probedSerial
+			}
+		}
 		if !t.Stop() {
 			response <- err
+		} else {
+			log.Debugf("Card answered %v in %v", probe.Command, latency.Round(time.Millisecond))
 		}
 	}
-	for range requestGPGCheck {
+
+	policies.read(agent, serial)
+	arrivals := inventory.watchArrivals()
+	var cardSettled <-chan time.Time
+
+	for {
+		var request GPGCheckRequest
+		select {
+		case key := <-arrivals:
+			if slices.Contains(key.Interfaces, notifier.INTERFACE_CCID) {
+				// Give a second for scdaemon to notice the new card
+				cardSettled = time.After(1 * time.Second)
+			}
+			continue
+		case <-cardSettled:
+			cardSettled = nil
+			latencies.reset()
+			serial = readCardSerial(agent)
+			policies.read(agent, serial)
+			continue
+		case request = <-requestGPGCheck:
+		}
+
+		if waits.waiting() {
+			log.Debugf("Not checking GPG key '%v', a wait is already going on", request.Keygrip)
+			continue
+		}
+		if keyring.openedForReload(request.Keygrip) {
+			log.Debugf("Ignoring GPG key '%v' opened while listing the secret keys", request.Keygrip)
+			continue
+		}
+
+		operation, key := keyring.describe(request.Keygrip, notifier.OPERATION_UNKNOWN)
+		card := request.CardSerial
+		if card == "" {
+			card = serial
+		}
+		policy := policies.of(card, operation)
+		if !policies.needsTouch(card, operation) {
+			log.Debugf("Not checking GPG %v operation, touch is disabled for it on the card", operation)
+			continue
+		}
+		if cachedUntil := policies.cachedUntil(card, operation); !cachedUntil.IsZero() {
+			log.Debugf("Not checking GPG %v operation, touch is cached for %v", operation, time.Until(cachedUntil).Round(time.Second))
+			continue
+		}
+
+		time.Sleep(200 * time.Millisecond) // wait for GPG to start talking with scdaemon
+
 		resp := make(chan error)
+		t := time.AfterFunc(latencies.threshold(), func() {
+			waits.start(notifier.Event{Operation: operation, GPGKey: key, TouchPolicy: policy, Process: request.Process, CardSerial: card, Device: inventory.findCard(card), State: gpgWaitState()})
 
-		t := time.AfterFunc(400*time.Millisecond, func() {
-			notifiers.Range(func(_, v interface{}) bool {
-				v.(chan notifier.Message) <- notifier.GPG_ON
-				return true
-			})
-			err := <-resp
-			if err != nil {
+			var cachedUntil time.Time
+			if err := <-resp; err != nil {
 				log.Errorf("Agent returned an error: %v", err)
+			} else {
+				cachedUntil = policies.touched(card, operation)
 			}
-			notifiers.Range(func(_, v interface{}) bool {
-				v.(chan notifier.Message) <- notifier.GPG_OFF
-				return true
-			})
+			waits.stop(cachedUntil)
 		})
 
-		time.Sleep(200 * time.Millisecond) // wait for GPG to start talking with scdaemon
-		check(resp, ctx, t)
+		check(resp, t)
 	}
 }
@@ -0,0 +1,209 @@
+package detector
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/proglottis/gpgme"
+	"github.com/rjeczalik/notify"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// How often an agent that is down is checked again
+const GPG_AGENT_CHECK_INTERVAL = 5 * time.Second
+
+// GPGAgent follows the gpg-agent of a home across restarts, tells when it is down,
+// and keeps a gpgme context connected to whichever agent is currently running
+type GPGAgent struct {
+	home       GPGHome
+	notifiers  *sync.Map
+	socketFile string
+	checks     chan bool
+
+	mutex sync.Mutex
+	up    bool
+
+	// The idle context, a command takes it for as long as it runs, so that a command that does not finish in time can be left behind
+	ctxMutex sync.Mutex
+	ctx      *gpgme.Context
+	ctxInode uint64
+}
+
+// FollowGPGAgent connects to the gpg-agent of a home, and starts checking whether the agent is up whenever its socket changes
+func FollowGPGAgent(home GPGHome, notifiers *sync.Map) (*GPGAgent, error) {
+	agent := &GPGAgent{
+		home:       home,
+		notifiers:  notifiers,
+		socketFile: home.findAgentSocket("agent-socket", "S.gpg-agent"),
+		checks:     make(chan bool, 1),
+		up:         true,
+	}
+	if err := agent.connect(); err != nil {
+		return nil, err
+	}
+	if agent.socketFile != "" {
+		go agent.watch()
+	}
+	return agent, nil
+}
+
+func (a *GPGAgent) watch() {
+	dir := path.Dir(a.socketFile)
+	waitForDir(dir)
+
+	events := initInotifyWatcher("gpg-agent", dir, notify.InCreate, notify.InDelete, notify.InMovedTo, notify.InMovedFrom)
+	defer notify.Stop(events)
+
+	ticker := time.NewTicker(GPG_AGENT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	a.check()
+	for {
+		select {
+		case event := <-events:
+			name := path.Base(event.Path())
+			if name == path.Base(a.socketFile) || name == path.Base(a.socketFile)+".original" {
+				a.check()
+			}
+		case <-a.checks:
+			a.check()
+		case <-ticker.C:
+			if !a.isUp() {
+				a.check()
+			}
+		}
+	}
+}
+
+// check tries to reach the agent, and tells the notifiers whenever it goes down or comes back
+func (a *GPGAgent) check() {
+	// Behind a proxy, the agent itself listens on the socket that was moved aside
+	socketFile := a.socketFile
+	if _, err := os.Stat(socketFile + ".original"); err == nil {
+		socketFile += ".original"
+	}
+	up := false
+	if conn, err := net.Dial("unix", socketFile); err == nil {
+		conn.Close()
+		up = true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if up == a.up {
+		return
+	}
+	a.up = up
+
+	message := notifier.GPG_AGENT_UP
+	if up {
+		log.Debugf("gpg-agent of '%v' is up again", a.home)
+	} else {
+		log.Warnf("gpg-agent of '%v' is down", a.home)
+		message = notifier.GPG_AGENT_DOWN
+	}
+	broadcast(a.notifiers, notifier.Event{Message: message, GPGHome: a.home.Dir})
+}
+
+func (a *GPGAgent) isUp() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.up
+}
+
+// requestCheck asks to check the agent soon, e.g. after a command failed
+func (a *GPGAgent) requestCheck() {
+	select {
+	case a.checks <- true:
+	default:
+	}
+}
+
+func (a *GPGAgent) connect() error {
+	ctx, err := a.home.NewAssuanContext()
+	if err != nil {
+		return err
+	}
+	a.ctx = ctx
+	a.ctxInode, _ = socketInode(a.socketFile)
+	return nil
+}
+
+// send runs an Assuan command on the agent, giving up on it after the timeout unless it is zero.
+// When the agent socket was created anew since the context was connected, i.e. the agent restarted,
+// or the last command failed, e.g. because the agent crashed, a new context is connected first.
+func (a *GPGAgent) send(command string, timeout time.Duration, status gpgme.AssuanStatusCallback) error {
+	ctx, inode, err := a.take()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- ctx.AssuanSend(command, nil, nil, status)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case err := <-result:
+		a.giveBack(ctx, inode, err)
+		return err
+	case <-expired:
+		// The context cannot be used until the command finishes, the next command connects anew meanwhile
+		go func() {
+			<-result
+			ctx.Release()
+		}()
+		return fmt.Errorf("no answer to %v within %v", command, timeout)
+	}
+}
+
+// take hands out the idle context, connecting one first if needed
+func (a *GPGAgent) take() (*gpgme.Context, uint64, error) {
+	a.ctxMutex.Lock()
+	defer a.ctxMutex.Unlock()
+
+	if a.ctx != nil {
+		if inode, err := socketInode(a.socketFile); err == nil && inode != a.ctxInode {
+			log.Debugf("gpg-agent socket of '%v' was created anew, connecting to it again", a.home)
+			a.ctx.Release()
+			a.ctx = nil
+		}
+	}
+	if a.ctx == nil {
+		if err := a.connect(); err != nil {
+			a.requestCheck()
+			return nil, 0, err
+		}
+	}
+
+	ctx, inode := a.ctx, a.ctxInode
+	a.ctx = nil
+	return ctx, inode, nil
+}
+
+// giveBack keeps a context that completed a command for the next one
+func (a *GPGAgent) giveBack(ctx *gpgme.Context, inode uint64, err error) {
+	a.ctxMutex.Lock()
+	defer a.ctxMutex.Unlock()
+
+	// Whether the connection broke or the card refused the command cannot be told apart, start afresh next time
+	if err != nil || a.ctx != nil {
+		ctx.Release()
+		if err != nil {
+			a.requestCheck()
+		}
+		return
+	}
+	a.ctx = ctx
+	a.ctxInode = inode
+}
@@ -0,0 +1,99 @@
+package detector
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/proglottis/gpgme"
+	log "github.com/sirupsen/logrus"
+)
+
+// GPGHome is a GnuPG home directory, each one is served by its own gpg-agent with its own sockets
+type GPGHome struct {
+	Dir string
+
+	// Default is set for the home gpg uses unless told otherwise,
+	// whose sockets are also found in $SSH_AUTH_SOCK or in $XDG_RUNTIME_DIR/gnupg
+	Default bool
+}
+
+// ParseGPGHomes reads a comma separated list of GnuPG home directories, the default home is used when the list is empty
+func ParseGPGHomes(value string, defaultDir string) []GPGHome {
+	if defaultDir != "" {
+		defaultDir = path.Clean(defaultDir)
+	}
+
+	var homes []GPGHome
+	seen := make(map[string]bool)
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		dir = path.Clean(dir)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		homes = append(homes, GPGHome{Dir: dir, Default: dir == defaultDir})
+	}
+
+	if len(homes) == 0 {
+		homes = append(homes, GPGHome{Dir: defaultDir, Default: true})
+	}
+	return homes
+}
+
+func (h GPGHome) String() string {
+	return h.Dir
+}
+
+// exitKey names what a detector needs to clean up for this home on exit
+func (h GPGHome) exitKey(name string) string {
+	if h.Default {
+		return name
+	}
+	return fmt.Sprintf("%v:%v", name, h.Dir)
+}
+
+// findAgentSocket asks gpgconf where one of the gpg-agent sockets of the home is,
+// falling back to its usual location for the default home
+func (h GPGHome) findAgentSocket(gpgconfDir string, fallbackName string) string {
+	agentSocket, err := exec.Command("gpgconf", "--homedir", h.Dir, "--list-dirs", gpgconfDir).CombinedOutput()
+	agentSocketOutput := strings.TrimSpace(string(agentSocket))
+	if err == nil {
+		return agentSocketOutput
+	}
+	log.Errorf("Cannot find %v of '%v' using gpgconf, error: %v, stderr: %v", gpgconfDir, h.Dir, err, agentSocketOutput)
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if h.Default && runtimeDir != "" {
+		return path.Join(runtimeDir, "gnupg", fallbackName)
+	}
+	return ""
+}
+
+// NewAssuanContext creates a gpgme context talking to the gpg-agent of the home
+func (h GPGHome) NewAssuanContext() (*gpgme.Context, error) {
+	ctx, err := gpgme.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.SetProtocol(gpgme.ProtocolAssuan); err != nil {
+		ctx.Release()
+		return nil, fmt.Errorf("cannot initialize Assuan IPC: %v", err)
+	}
+
+	// The Assuan engine connects to the socket it is given, which is the agent of the default home otherwise
+	if socketFile := h.findAgentSocket("agent-socket", "S.gpg-agent"); socketFile != "" {
+		if err := ctx.SetEngineInfo(gpgme.ProtocolAssuan, socketFile, h.Dir); err != nil {
+			ctx.Release()
+			return nil, fmt.Errorf("cannot connect to gpg-agent at '%v': %v", socketFile, err)
+		}
+	}
+	return ctx, nil
+}
@@ -0,0 +1,235 @@
+package detector
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	// https://github.com/gpg/gnupg/blob/master/doc/DETAILS
+	GPG_COLONS_RECORD_TYPE  = 0
+	GPG_COLONS_KEY_ID       = 4
+	GPG_COLONS_USER_ID      = 9
+	GPG_COLONS_CAPABILITIES = 11
+
+	GPG_CAPABILITY_SIGN         = "s"
+	GPG_CAPABILITY_ENCRYPT      = "e"
+	GPG_CAPABILITY_AUTHENTICATE = "a"
+
+	// How often the secret keys may be listed again when an unknown keygrip comes up
+	GPG_KEYRING_RELOAD_INTERVAL = 10 * time.Second
+
+	// How long after listing the secret keys the key files gpg-agent opened for it may still be reported
+	GPG_KEYRING_RELOAD_GRACE = 500 * time.Millisecond
+)
+
+// gpgSubkey is a secret subkey, as known by its keygrip
+type gpgSubkey struct {
+	key          notifier.GPGKey
+	capabilities string
+}
+
+// operation guesses what a subkey is used for, by its capabilities
+func (s gpgSubkey) operation() notifier.Operation {
+	switch {
+	case strings.Contains(s.capabilities, GPG_CAPABILITY_SIGN):
+		return notifier.OPERATION_SIGN
+	case strings.Contains(s.capabilities, GPG_CAPABILITY_ENCRYPT):
+		return notifier.OPERATION_DECRYPT
+	case strings.Contains(s.capabilities, GPG_CAPABILITY_AUTHENTICATE):
+		return notifier.OPERATION_AUTHENTICATE
+	}
+	return notifier.OPERATION_UNKNOWN
+}
+
+// GPGKeyring maps keygrips of secret subkeys to the keys they belong to
+type GPGKeyring struct {
+	homedir string
+	mutex   sync.Mutex
+	subkeys map[string]gpgSubkey
+	loaded  time.Time
+
+	// Keygrips that were still unknown after listing the keys again, e.g. of key files without a public key.
+	// Listing the keys opens the key files, which must not lead to listing them again and again.
+	unknown map[string]bool
+
+	// Keygrips looked up while they were not known, the next listing tells whether they belong to any secret key
+	missing map[string]bool
+
+	// Whether the keys are being listed, or when they were listed the last time
+	reloading bool
+	reloaded  time.Time
+}
+
+// NewGPGKeyring lists the secret keys of a GnuPG home directory
+func NewGPGKeyring(homedir string) *GPGKeyring {
+	keyring := &GPGKeyring{homedir: homedir, subkeys: make(map[string]gpgSubkey), unknown: make(map[string]bool), missing: make(map[string]bool)}
+	keyring.loaded = time.Now()
+	keyring.reloading = true
+	keyring.reload()
+	return keyring
+}
+
+// lookup finds the subkey of a keygrip in the last listing of the secret keys,
+// and lists them again in the background if it is not known yet
+func (k *GPGKeyring) lookup(keygrip string) (gpgSubkey, bool) {
+	if k == nil || keygrip == "" {
+		return gpgSubkey{}, false
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	keygrip = strings.ToUpper(keygrip)
+	if subkey, ok := k.subkeys[keygrip]; ok {
+		return subkey, true
+	}
+	if !k.unknown[keygrip] {
+		k.missing[keygrip] = true
+		k.refresh()
+	}
+	return gpgSubkey{}, false
+}
+
+// describe tells what a keygrip is used for and which key it belongs to, falling back to the given operation
+func (k *GPGKeyring) describe(keygrip string, operation notifier.Operation) (notifier.Operation, *notifier.GPGKey) {
+	subkey, ok := k.lookup(keygrip)
+	if !ok {
+		return operation, nil
+	}
+	if operation == notifier.OPERATION_UNKNOWN {
+		operation = subkey.operation()
+	}
+	return operation, &subkey.key
+}
+
+// openedForReload tells whether the key file of a keygrip may have been opened by gpg-agent to list the secret keys,
+// i.e. the keys are being listed right now or just were, and the keygrip is one of those listed.
+// Such an open is no sign of an operation waiting for a touch.
+func (k *GPGKeyring) openedForReload(keygrip string) bool {
+	if k == nil {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !k.reloading && time.Since(k.reloaded) >= GPG_KEYRING_RELOAD_GRACE {
+		return false
+	}
+	_, listed := k.subkeys[strings.ToUpper(keygrip)]
+	return listed
+}
+
+// refresh lists the secret keys again in the background, unless they were listed recently,
+// so that nobody waits for gpg meanwhile. The mutex must be held.
+func (k *GPGKeyring) refresh() {
+	if k.reloading || time.Since(k.loaded) < GPG_KEYRING_RELOAD_INTERVAL {
+		return
+	}
+	k.loaded = time.Now()
+	k.reloading = true
+	go k.reload()
+}
+
+func (k *GPGKeyring) reload() {
+	// The keygrips of subkeys are not exposed by gpgme bindings, gpg itself knows them
+	args := []string{"--batch", "--with-colons", "--with-keygrip", "--list-secret-keys"}
+	if k.homedir != "" {
+		args = append([]string{"--homedir", k.homedir}, args...)
+	}
+	output, err := exec.Command("gpg", args...).Output()
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.reloading = false
+	k.reloaded = time.Now()
+	if err != nil {
+		log.Errorf("Cannot list GPG secret keys: %v", err)
+		return
+	}
+
+	k.subkeys = parseGPGSecretKeys(string(output))
+	log.Debugf("Found %v GPG secret subkeys", len(k.subkeys))
+
+	for keygrip := range k.missing {
+		if _, ok := k.subkeys[keygrip]; !ok {
+			log.Debugf("GPG keygrip '%v' does not belong to any secret key", keygrip)
+			k.unknown[keygrip] = true
+		}
+	}
+	k.missing = make(map[string]bool)
+}
+
+// parseGPGSecretKeys reads the output of gpg --with-colons --with-keygrip --list-secret-keys
+func parseGPGSecretKeys(output string) map[string]gpgSubkey {
+	subkeys := make(map[string]gpgSubkey)
+
+	var keyKeygrips []string
+	var userID string
+	var current *gpgSubkey
+	flush := func() {
+		for _, keygrip := range keyKeygrips {
+			subkey := subkeys[keygrip]
+			subkey.key.UserID = userID
+			subkeys[keygrip] = subkey
+		}
+		keyKeygrips = nil
+		userID = ""
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) <= GPG_COLONS_USER_ID {
+			continue
+		}
+
+		switch fields[GPG_COLONS_RECORD_TYPE] {
+		case "sec":
+			flush()
+			fallthrough
+		case "ssb":
+			current = &gpgSubkey{key: notifier.GPGKey{KeyID: fields[GPG_COLONS_KEY_ID]}}
+			if len(fields) > GPG_COLONS_CAPABILITIES {
+				current.capabilities = fields[GPG_COLONS_CAPABILITIES]
+			}
+		case "grp":
+			// The keygrip follows the key it belongs to
+			if current != nil {
+				keygrip := strings.ToUpper(fields[GPG_COLONS_USER_ID])
+				current.key.Keygrip = keygrip
+				subkeys[keygrip] = *current
+				keyKeygrips = append(keyKeygrips, keygrip)
+				current = nil
+			}
+		case "uid":
+			if userID == "" {
+				userID = unescapeGPGColons(fields[GPG_COLONS_USER_ID])
+			}
+		}
+	}
+	flush()
+
+	return subkeys
+}
+
+// unescapeGPGColons decodes the C-style \xHH escaping of gpg --with-colons fields
+func unescapeGPGColons(value string) string {
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if decoded, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				result.WriteByte(byte(decoded))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(value[i])
+	}
+	return result.String()
+}
@@ -0,0 +1,129 @@
+package detector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// How often pinentry is looked for while the card is waiting
+const GPG_PINENTRY_POLL_INTERVAL = 200 * time.Millisecond
+
+// GPGWaits counts card operations in progress in a home, whichever detector follows them,
+// so that a single wait is reported however many detectors notice the same operation
+type GPGWaits struct {
+	mutex     sync.Mutex
+	notifiers *sync.Map
+	home      GPGHome
+	active    int
+	event     notifier.Event
+
+	// The latest expiry of cached touches among the operations that completed during the wait
+	cachedUntil time.Time
+
+	// The pinentry gpg-agent announced during the wait, if any, and what stops following pinentry when the wait is over
+	pinentry int
+	done     chan bool
+}
+
+func NewGPGWaits(home GPGHome, notifiers *sync.Map) *GPGWaits {
+	return &GPGWaits{notifiers: notifiers, home: home}
+}
+
+// waiting tells whether a wait is going on
+func (w *GPGWaits) waiting() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.active > 0
+}
+
+// start announces a wait, unless one is already going on, the event tells what the operation is
+func (w *GPGWaits) start(event notifier.Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.active++
+	if w.active == 1 {
+		event.Message = notifier.GPG_ON
+		event.GPGHome = w.home.Dir
+		w.event = event
+		broadcast(w.notifiers, w.event)
+
+		w.done = make(chan bool)
+		go w.followPinentry(w.done)
+	}
+}
+
+// update tells what the ongoing wait is waiting for
+func (w *GPGWaits) update(state notifier.State) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.setState(state)
+}
+
+// pinentryLaunched reports that the ongoing wait waits for the PIN, for as long as the given pinentry runs
+func (w *GPGWaits) pinentryLaunched(pid int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.active > 0 {
+		w.pinentry = pid
+		w.setState(notifier.STATE_PIN)
+	}
+}
+
+func (w *GPGWaits) stop(cachedUntil time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.active--
+	if cachedUntil.After(w.cachedUntil) {
+		w.cachedUntil = cachedUntil
+	}
+	if w.active == 0 {
+		close(w.done)
+		w.pinentry = 0
+		broadcast(w.notifiers, notifier.Event{Message: notifier.GPG_OFF, GPGHome: w.home.Dir, TouchCachedUntil: w.cachedUntil})
+		w.cachedUntil = time.Time{}
+	}
+}
+
+// followPinentry tells whether the ongoing wait waits for the PIN or for a touch, until it is over,
+// as the card is also busy while the PIN is being typed
+func (w *GPGWaits) followPinentry(done chan bool) {
+	ticker := time.NewTicker(GPG_PINENTRY_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		w.mutex.Lock()
+		select {
+		case <-done:
+		default:
+			state := gpgWaitState()
+			if w.pinentry > 0 && isProcessRunning(w.pinentry) {
+				state = notifier.STATE_PIN
+			}
+			w.setState(state)
+		}
+		w.mutex.Unlock()
+	}
+}
+
+func (w *GPGWaits) setState(state notifier.State) {
+	if w.active > 0 && w.event.State != state {
+		w.event.State = state
+		w.event.Update = true
+		broadcast(w.notifiers, w.event)
+	}
+}
+
+// gpgWaitState tells whether the card waits for the PIN to be typed or for a touch
+func gpgWaitState() notifier.State {
+	if findPinentry() != nil {
+		return notifier.STATE_PIN
+	}
+	return notifier.STATE_TOUCH
+}
@@ -1,14 +1,12 @@
 package detector
 
 import (
-	"fmt"
 	"os"
 	"path"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/deckarep/golang-set"
 	"github.com/rjeczalik/notify"
 	log "github.com/sirupsen/logrus"
 
@@ -16,16 +14,21 @@ import (
 )
 
 // WatchHMAC watches when YubiKey is waiting for a touch on a HMAC request
-func WatchHMAC(notifiers *sync.Map) {
+func WatchHMAC(notifiers *sync.Map, filter DeviceFilter) {
 	devicesEvents := initInotifyWatcher("HMAC", "/dev", notify.Create, notify.Remove)
 	defer notify.Stop(devicesEvents)
 
-	yubikeyHidrawDevices := mapset.NewSet()
+	// All hidraw interfaces of connected YubiKeys, and the keys whose OTP interface vanished
+	yubikeyHidrawDevices := make(map[string]notifier.Device)
+	waitingKeys := make(map[string]notifier.Device)
+	mutex := sync.Mutex{}
+
 	if devices, err := os.ReadDir("/dev"); err == nil {
 		for _, device := range devices {
 			devicePath := path.Join("/dev", device.Name())
-			if isYubikeyHidrawDevice(devicePath) {
-				yubikeyHidrawDevices.Add(devicePath)
+			if yubikey, ok := readYubikeyHidrawDevice(devicePath, filter); ok {
+				yubikeyHidrawDevices[devicePath] = yubikey
+				inventory.interfaceAdded(notifiers, yubikey)
 			}
 		}
 	} else {
@@ -33,63 +36,128 @@ func WatchHMAC(notifiers *sync.Map) {
 	}
 
 	lastMessage := notifier.HMAC_OFF
-	var onRemoveTimer *time.Timer
+	reported := "" // the identity of the waiting key the last event told about
+	notifyChange := func(device notifier.Device) {
+		newMessage := notifier.HMAC_OFF
+		if len(waitingKeys) > 0 {
+			newMessage = notifier.HMAC_ON
+		}
+		if lastMessage != newMessage {
+			broadcast(notifiers, notifier.Event{Message: newMessage, Device: &device})
+			reported = device.Identity()
+		} else if _, ok := waitingKeys[reported]; newMessage == notifier.HMAC_ON && !ok {
+			// The key that was told about is done, while another one still waits
+			for identity, waiting := range waitingKeys {
+				device := waiting
+				broadcast(notifiers, notifier.Event{Message: notifier.HMAC_ON, Device: &device, Update: true})
+				reported = identity
+				break
+			}
+		}
+		lastMessage = newMessage
+	}
+
+	// Interfaces of the same key vanish together when it is unplugged, so they are looked at together
+	removeTimers := make(map[string]*time.Timer)
+	onRemove := func(yubikey notifier.Device) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		identity := yubikey.Identity()
+		delete(removeTimers, identity)
+
+		if !isYubikeyConnected(yubikey, yubikeyHidrawDevices) {
+			log.Debugf("YubiKey %v was removed", yubikey)
+			for devicePath, other := range yubikeyHidrawDevices {
+				if other.Identity() == identity {
+					delete(yubikeyHidrawDevices, devicePath)
+				}
+			}
+			delete(waitingKeys, identity)
+			notifyChange(yubikey)
+			inventory.keyRemoved(notifiers, yubikey)
+			return
+		}
+
+		// The OTP interface vanishes while the key is waiting for a touch, the rest of the key stays
+		hasOTP := false
+		for _, other := range yubikeyHidrawDevices {
+			if other.Identity() == identity && other.Interface == notifier.INTERFACE_OTP {
+				hasOTP = true
+			}
+		}
+		if !hasOTP {
+			waitingKeys[identity] = yubikey
+		}
+		notifyChange(yubikey)
+	}
+
 	for event := range devicesEvents {
 		switch event.Event() {
 		case notify.Create:
-			if onRemoveTimer != nil {
-				onRemoveTimer.Stop()
+			if yubikey, ok := readYubikeyHidrawDevice(event.Path(), filter); ok {
+				mutex.Lock()
+				if timer, ok := removeTimers[yubikey.Identity()]; ok {
+					timer.Stop()
+					delete(removeTimers, yubikey.Identity())
+				}
+				mutex.Unlock()
 			}
+
 			// Give a second for device to initialize
 			time.Sleep(1 * time.Second)
 
-			if isYubikeyHidrawDevice(event.Path()) {
-				yubikeyHidrawDevices.Add(event.Path())
-
-				newMessage := notifier.HMAC_OFF
-				if lastMessage != newMessage {
-					notifiers.Range(func(_, v interface{}) bool {
-						v.(chan notifier.Message) <- newMessage
-						return true
-					})
+			if yubikey, ok := readYubikeyHidrawDevice(event.Path(), filter); ok {
+				mutex.Lock()
+				yubikeyHidrawDevices[event.Path()] = yubikey
+				inventory.interfaceAdded(notifiers, yubikey)
+				if yubikey.Interface == notifier.INTERFACE_OTP {
+					delete(waitingKeys, yubikey.Identity())
 				}
-				lastMessage = newMessage
+				notifyChange(yubikey)
+				mutex.Unlock()
 			}
 		case notify.Remove:
-			if yubikeyHidrawDevices.Contains(event.Path()) {
-				if onRemoveTimer != nil {
-					onRemoveTimer.Stop()
-				}
+			mutex.Lock()
+			if yubikey, ok := yubikeyHidrawDevices[event.Path()]; ok {
+				delete(yubikeyHidrawDevices, event.Path())
 
-				yubikeyHidrawDevices.Remove(event.Path())
-
-				onRemoveTimer = time.AfterFunc(1*time.Second, func() {
-					newMessage := notifier.HMAC_OFF
-					if yubikeyHidrawDevices.Cardinality() > 0 {
-						newMessage = notifier.HMAC_ON
-					}
-
-					if lastMessage != newMessage {
-						notifiers.Range(func(_, v interface{}) bool {
-							v.(chan notifier.Message) <- newMessage
-							return true
-						})
-					}
-
-					lastMessage = newMessage
-				})
+				identity := yubikey.Identity()
+				if timer, ok := removeTimers[identity]; ok {
+					timer.Stop()
+				}
+				removeTimers[identity] = time.AfterFunc(1*time.Second, func() { onRemove(yubikey) })
 			}
+			mutex.Unlock()
 		}
 	}
 }
 
-func isYubikeyHidrawDevice(devicePath string) bool {
-	if strings.HasPrefix(devicePath, "/dev/hidraw") {
-		if info, err := os.ReadFile(fmt.Sprintf("/sys/class/hidraw/%v/device/uevent", path.Base(devicePath))); err == nil {
-			if strings.Contains(strings.ToLower(string(info)), "yubikey") {
-				return true
-			}
+// isYubikeyConnected tells whether the USB device of a key is still there, whichever interfaces it has,
+// as a key with only OTP enabled has no other interface left while it waits for a touch.
+// For keys that are not connected over USB it is enough that any of their hidraw interfaces is still there.
+func isYubikeyConnected(yubikey notifier.Device, yubikeyHidrawDevices map[string]notifier.Device) bool {
+	if yubikey.SysfsPath != "" {
+		return sysfsExists(yubikey.SysfsPath, "idVendor")
+	}
+
+	for _, other := range yubikeyHidrawDevices {
+		if other.Identity() == yubikey.Identity() {
+			return true
 		}
 	}
 	return false
 }
+
+// readYubikeyHidrawDevice identifies a hidraw device, if it belongs to a YubiKey
+func readYubikeyHidrawDevice(devicePath string, filter DeviceFilter) (notifier.Device, bool) {
+	if !strings.HasPrefix(devicePath, "/dev/hidraw") {
+		return notifier.Device{}, false
+	}
+
+	device, err := readHidrawDevice(devicePath)
+	if err != nil {
+		return device, false
+	}
+	return device, (device.VendorID == USB_VENDOR_YUBICO || filter.includes(device)) && filter.allows(device)
+}
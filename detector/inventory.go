@@ -0,0 +1,196 @@
+package detector
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// keyInventory knows which keys are connected, out of the interfaces all detectors come across.
+// A key arrives with its first interface and leaves with its last one.
+type keyInventory struct {
+	mutex      sync.Mutex
+	interfaces map[string]map[string]notifier.Device
+	keys       map[string]notifier.Key
+	arrivals   []chan notifier.Key
+}
+
+var inventory = &keyInventory{
+	interfaces: make(map[string]map[string]notifier.Device),
+	keys:       make(map[string]notifier.Key),
+}
+
+func (i *keyInventory) interfaceAdded(notifiers *sync.Map, device notifier.Device) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	identity := device.Identity()
+	interfaces, known := i.interfaces[identity]
+	if !known {
+		interfaces = make(map[string]notifier.Device)
+		i.interfaces[identity] = interfaces
+	}
+	interfaces[device.Path] = device
+
+	i.describe(notifiers, device, !known)
+}
+
+func (i *keyInventory) interfaceRemoved(notifiers *sync.Map, device notifier.Device) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	identity := device.Identity()
+	interfaces, known := i.interfaces[identity]
+	if !known {
+		return
+	}
+	delete(interfaces, device.Path)
+
+	if len(interfaces) > 0 {
+		i.describe(notifiers, device, false)
+		return
+	}
+
+	key := i.keys[identity]
+	delete(i.interfaces, identity)
+	delete(i.keys, identity)
+	log.Debugf("Security key %v left", device)
+	broadcast(notifiers, notifier.Event{Message: notifier.DEVICE_OFF, Device: &device, Key: &key})
+}
+
+// keyRemoved forgets all interfaces of a key at once, once it is known to be unplugged
+func (i *keyInventory) keyRemoved(notifiers *sync.Map, device notifier.Device) {
+	i.mutex.Lock()
+	var interfaces []notifier.Device
+	for _, other := range i.interfaces[device.Identity()] {
+		interfaces = append(interfaces, other)
+	}
+	i.mutex.Unlock()
+
+	for _, other := range interfaces {
+		i.interfaceRemoved(notifiers, other)
+	}
+}
+
+// describe refreshes the description of a key, announcing it if it just arrived or if it changed since
+func (i *keyInventory) describe(notifiers *sync.Map, device notifier.Device, arrived bool) {
+	identity := device.Identity()
+	key := describeKey(device, i.interfaces[identity])
+	previous, known := i.keys[identity]
+	i.keys[identity] = key
+
+	if arrived {
+		log.Debugf("Security key %v arrived", device)
+		broadcast(notifiers, notifier.Event{Message: notifier.DEVICE_ON, Device: &device, Key: &key})
+		for _, arrivals := range i.arrivals {
+			select {
+			case arrivals <- key:
+			default:
+			}
+		}
+	} else if !known || !key.Equal(previous) {
+		broadcast(notifiers, notifier.Event{Message: notifier.DEVICE_ON, Device: &device, Key: &key, Update: true})
+	}
+}
+
+// watchArrivals returns a channel receiving keys as they are plugged in
+func (i *keyInventory) watchArrivals() chan notifier.Key {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	arrivals := make(chan notifier.Key, 10)
+	i.arrivals = append(i.arrivals, arrivals)
+	return arrivals
+}
+
+// ListKeys looks for connected security keys without the help of a running detector
+func ListKeys(filter DeviceFilter) ([]notifier.Key, error) {
+	devices, err := os.ReadDir("/dev")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list devices in '/dev': %v", err)
+	}
+
+	interfaces := make(map[string]map[string]notifier.Device)
+	for _, entry := range devices {
+		devicePath := path.Join("/dev", entry.Name())
+		if !strings.HasPrefix(devicePath, "/dev/hidraw") {
+			continue
+		}
+		device, err := readHidrawDevice(devicePath)
+		if err != nil {
+			continue
+		}
+		isFido, _ := isFidoU2FDevice(devicePath)
+		if !(isFido || device.VendorID == USB_VENDOR_YUBICO || filter.includes(device)) || !filter.allows(device) {
+			continue
+		}
+
+		if interfaces[device.Identity()] == nil {
+			interfaces[device.Identity()] = make(map[string]notifier.Device)
+		}
+		interfaces[device.Identity()][devicePath] = device
+	}
+
+	var keys []notifier.Key
+	for _, keyInterfaces := range interfaces {
+		for _, device := range keyInterfaces {
+			keys = append(keys, describeKey(device, keyInterfaces))
+			break
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].ID < keys[b].ID })
+	return keys, nil
+}
+
+// describeKey puts together what sysfs knows about the USB device of a key and the hidraw interfaces seen so far
+func describeKey(device notifier.Device, interfaces map[string]notifier.Device) notifier.Key {
+	key := notifier.Key{
+		ID:        device.Identity(),
+		Name:      device.Name,
+		VendorID:  device.VendorID,
+		ProductID: device.ProductID,
+		Serial:    device.Serial,
+		Watched:   u2fWatchers.watching(device.Identity()),
+	}
+
+	kinds := make(map[string]bool)
+	for devicePath, other := range interfaces {
+		key.HidrawPaths = append(key.HidrawPaths, devicePath)
+		if other.Interface != "" {
+			kinds[other.Interface] = true
+		}
+	}
+	sort.Strings(key.HidrawPaths)
+
+	if device.SysfsPath != "" {
+		if product := readSysfsAttribute(device.SysfsPath, "product"); product != "" {
+			key.Name = product
+		}
+		if bcdDevice, err := strconv.ParseUint(readSysfsAttribute(device.SysfsPath, "bcdDevice"), 16, 16); err == nil {
+			// YubiKeys report their firmware version as 0xMMmp
+			key.Firmware = fmt.Sprintf("%d.%d.%d", bcdDevice>>8, (bcdDevice>>4)&0xf, bcdDevice&0xf)
+		}
+
+		// The smart card interface has no hidraw node, only sysfs knows about it
+		usbInterfaces, _ := filepath.Glob(path.Join(device.SysfsPath, path.Base(device.SysfsPath)+":*"))
+		for _, usbInterfaceDir := range usbInterfaces {
+			if kind := readUSBInterfaceKind(usbInterfaceDir); kind != "" {
+				kinds[kind] = true
+			}
+		}
+	}
+
+	for kind := range kinds {
+		key.Interfaces = append(key.Interfaces, kind)
+	}
+	sort.Strings(key.Interfaces)
+	return key
+}
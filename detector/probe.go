@@ -0,0 +1,88 @@
+package detector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a probe may take before the card is assumed to be waiting for a touch, until its baseline latency is known
+	GPG_PROBE_THRESHOLD = 400 * time.Millisecond
+
+	// How much slower than its baseline a probe has to be for the card to be assumed waiting for a touch
+	GPG_PROBE_MARGIN = 200 * time.Millisecond
+
+	// The threshold never grows beyond this, however slow the card seems to be
+	GPG_PROBE_MAX_THRESHOLD = 1 * time.Second
+
+	// How many latencies of recent probes the baseline is found from, and how many it takes at least
+	GPG_PROBE_SAMPLES     = 10
+	GPG_PROBE_MIN_SAMPLES = 3
+)
+
+// CardProbe is a command sent to the card through gpg-agent, which cannot be answered while the card waits for a touch
+type CardProbe struct {
+	Name    string
+	Command string
+
+	// Timeout is how long an answer is awaited at most, the wait is given up afterwards
+	Timeout time.Duration
+}
+
+// CardProbes are the available probes, from the heaviest to the lightest one.
+// Commands that scdaemon answers without taking the card, such as SCD NOP, never notice a card waiting for a touch.
+var CardProbes = []CardProbe{
+	// Makes gpg-agent read all card data again, as gpg --card-status does
+	{Name: "learn", Command: "LEARN", Timeout: 60 * time.Second},
+	// Selects the OpenPGP application and reads the serial number of the card
+	{Name: "serialno", Command: "SCD SERIALNO", Timeout: 30 * time.Second},
+}
+
+// FindCardProbe looks up a probe by its name
+func FindCardProbe(name string) (CardProbe, error) {
+	index := slices.IndexFunc(CardProbes, func(probe CardProbe) bool { return probe.Name == name })
+	if index < 0 {
+		names := make([]string, 0, len(CardProbes))
+		for _, probe := range CardProbes {
+			names = append(names, probe.Name)
+		}
+		return CardProbe{}, fmt.Errorf("unknown card probe '%v', expected one of %v", name, strings.Join(names, ", "))
+	}
+	return CardProbes[index], nil
+}
+
+// probeLatencies remembers how long recent probes of a card took, to tell a slow card from a card waiting for a touch
+type probeLatencies struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+}
+
+func (l *probeLatencies) record(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.samples = append(l.samples, latency)
+	if len(l.samples) > GPG_PROBE_SAMPLES {
+		l.samples = l.samples[len(l.samples)-GPG_PROBE_SAMPLES:]
+	}
+}
+
+// reset forgets the latencies, e.g. when another card is plugged in
+func (l *probeLatencies) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.samples = nil
+}
+
+// threshold tells how long a probe may take before the card is assumed to be waiting for a touch.
+// A touch only ever makes a probe slower, so the fastest recent probe is the baseline of the card.
+func (l *probeLatencies) threshold() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < GPG_PROBE_MIN_SAMPLES {
+		return GPG_PROBE_THRESHOLD
+	}
+	return min(slices.Min(l.samples)+GPG_PROBE_MARGIN, GPG_PROBE_MAX_THRESHOLD)
+}
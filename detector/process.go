@@ -0,0 +1,252 @@
+package detector
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+type cachedProcess struct {
+	startTime string
+	process   notifier.Process
+}
+
+var processCache = struct {
+	sync.Mutex
+	processes map[int]cachedProcess
+}{processes: make(map[int]cachedProcess)}
+
+// findProcessUsingFile scans /proc/*/fd for the first process (apart from ourselves) that has the file open
+func findProcessUsingFile(filePath string) *notifier.Process {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		log.Debugf("Cannot list processes to find who uses '%v': %v", filePath, err)
+		return nil
+	}
+
+	defer pruneProcessCache(entries)
+
+	self := os.Getpid()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		fdDir := path.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// Most probably the process belongs to another user or has already exited
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(path.Join(fdDir, fd.Name())); err == nil && target == filePath {
+				if process, ok := describeProcess(pid); ok {
+					return &process
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// findPinentry looks for a running pinentry of the current user, which gpg-agent launches to ask for the PIN
+func findPinentry() *notifier.Process {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		log.Debugf("Cannot list processes to find pinentry: %v", err)
+		return nil
+	}
+
+	uid := os.Getuid()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(path.Join("/proc", entry.Name(), "comm"))
+		if err != nil || !strings.HasPrefix(string(comm), "pinentry") {
+			continue
+		}
+		if info, err := os.Stat(path.Join("/proc", entry.Name())); err != nil || info.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+			continue
+		}
+		if process, ok := describeProcess(pid); ok {
+			return &process
+		}
+	}
+	return nil
+}
+
+// gpgClients are the programs that ask gpg-agent to use a key, the agent itself then opens the key file
+var gpgClients = map[string]bool{
+	"gpg":               true,
+	"gpg2":              true,
+	"gpgsm":             true,
+	"gpg-connect-agent": true,
+	"ssh":               true,
+}
+
+// launchers start programs on behalf of the user, rather than on behalf of another program
+var launchers = map[string]bool{
+	"sh":      true,
+	"bash":    true,
+	"dash":    true,
+	"zsh":     true,
+	"fish":    true,
+	"ksh":     true,
+	"tcsh":    true,
+	"sudo":    true,
+	"doas":    true,
+	"systemd": true,
+}
+
+// findGPGRequester guesses on whose behalf gpg-agent uses a key: the most recently started gpg client of the current user,
+// or the program that launched it, e.g. git or pass, unless it was launched from a shell or alike
+func findGPGRequester() *notifier.Process {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		log.Debugf("Cannot list processes to find the gpg client: %v", err)
+		return nil
+	}
+
+	uid := os.Getuid()
+	client := 0
+	var clientStartTime uint64
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !gpgClients[processComm(pid)] {
+			continue
+		}
+		if info, err := os.Stat(path.Join("/proc", entry.Name())); err != nil || info.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+			continue
+		}
+		stat, err := os.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		if startTime, _ := strconv.ParseUint(processStartTime(string(stat)), 10, 64); client == 0 || startTime > clientStartTime {
+			client = pid
+			clientStartTime = startTime
+		}
+	}
+	if client == 0 {
+		return nil
+	}
+
+	if parent := processParent(client); parent > 1 && !launchers[processComm(parent)] {
+		if process, ok := describeProcess(parent); ok {
+			process = namedAfterScript(process)
+			return &process
+		}
+	}
+	if process, ok := describeProcess(client); ok {
+		return &process
+	}
+	return nil
+}
+
+// namedAfterScript names a script run by an interpreter after the script, e.g. pass rather than bash
+func namedAfterScript(process notifier.Process) notifier.Process {
+	comm := processComm(process.PID)
+	if len(process.CommandLine) > 1 && comm != "" && comm != path.Base(process.Executable) &&
+		strings.HasPrefix(path.Base(process.CommandLine[1]), comm) {
+		process.Executable = process.CommandLine[1]
+	}
+	return process
+}
+
+// isProcessRunning tells whether a process still exists
+func isProcessRunning(pid int) bool {
+	_, err := os.Stat(path.Join("/proc", strconv.Itoa(pid)))
+	return err == nil
+}
+
+// describeProcess reads the executable and the command line of a process, caching them until the pid is reused
+func describeProcess(pid int) (notifier.Process, bool) {
+	procDir := path.Join("/proc", strconv.Itoa(pid))
+
+	stat, err := os.ReadFile(path.Join(procDir, "stat"))
+	if err != nil {
+		return notifier.Process{}, false
+	}
+	startTime := processStartTime(string(stat))
+
+	processCache.Lock()
+	defer processCache.Unlock()
+
+	if cached, ok := processCache.processes[pid]; ok && cached.startTime == startTime {
+		return cached.process, true
+	}
+
+	process := notifier.Process{PID: pid}
+	if executable, err := os.Readlink(path.Join(procDir, "exe")); err == nil {
+		process.Executable = strings.TrimSuffix(executable, " (deleted)")
+	}
+	if cmdline, err := os.ReadFile(path.Join(procDir, "cmdline")); err == nil {
+		process.CommandLine = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	}
+	if process.Executable == "" && len(process.CommandLine) > 0 {
+		process.Executable = process.CommandLine[0]
+	}
+	processCache.processes[pid] = cachedProcess{startTime: startTime, process: process}
+	return process, true
+}
+
+// pruneProcessCache forgets processes that are no longer running
+func pruneProcessCache(entries []os.DirEntry) {
+	running := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			running[pid] = true
+		}
+	}
+
+	processCache.Lock()
+	defer processCache.Unlock()
+	for pid := range processCache.processes {
+		if !running[pid] {
+			delete(processCache.processes, pid)
+		}
+	}
+}
+
+// processComm reads the name of a process as the kernel knows it, truncated to 15 chars
+func processComm(pid int) string {
+	comm, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// processParent reads the parent pid of a process from /proc/<pid>/stat, or returns 0 if it is gone
+func processParent(pid int) int {
+	stat, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(stat)[strings.LastIndex(string(stat), ")")+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+// processStartTime extracts the 22nd field of /proc/<pid>/stat, the comm field may contain spaces and parentheses
+func processStartTime(stat string) string {
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
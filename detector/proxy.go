@@ -0,0 +1,196 @@
+package detector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rjeczalik/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+// socketProxy listens in place of a socket that was moved aside, and connects every client to the original socket
+type socketProxy struct {
+	name               string
+	socketFile         string
+	originalSocketFile string
+	listener           *net.UnixListener
+	inode              uint64
+
+	// gone receives a value when the original socket refuses connections, i.e. whoever served it is gone
+	gone chan<- bool
+}
+
+// startSocketProxy moves a socket aside and starts listening in its place,
+// every incoming connection is handed over together with a new connection to the original socket
+func startSocketProxy(name string, socketFile string, handle func(client net.Conn, original net.Conn), gone chan<- bool) (*socketProxy, error) {
+	if _, err := os.Stat(socketFile); err != nil {
+		return nil, fmt.Errorf("the socket '%v' does not exist: %v", socketFile, err)
+	}
+
+	originalSocketFile := socketFile + ".original"
+	if _, err := os.Stat(originalSocketFile); err == nil {
+		log.Warnf("'%v' already exists, assuming it's the correct one and trying to recover", originalSocketFile)
+		if err = os.Remove(socketFile); err != nil {
+			return nil, fmt.Errorf("cannot remove '%v' in order to recover from possible previous crash", socketFile)
+		}
+	} else {
+		if err := os.Rename(socketFile, originalSocketFile); err != nil {
+			return nil, fmt.Errorf("cannot move original socket file to setup a proxy: %v", err)
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketFile, Net: "unix"})
+	if err != nil {
+		if err := os.Rename(originalSocketFile, socketFile); err != nil {
+			log.Errorf("Cannot restore original %v socket: %v", name, err)
+		}
+		return nil, fmt.Errorf("cannot establish a proxy socket: %v", err)
+	}
+
+	proxy := &socketProxy{name: name, socketFile: socketFile, originalSocketFile: originalSocketFile, listener: listener, gone: gone}
+	proxy.inode, _ = socketInode(socketFile)
+	log.Debugf("%v watcher is successfully established", name)
+
+	go proxy.accept(handle)
+	return proxy, nil
+}
+
+func (p *socketProxy) accept(handle func(client net.Conn, original net.Conn)) {
+	for {
+		proxyConnection, err := p.listener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Error("Cannot accept incoming proxy connection: ", err)
+			}
+			return
+		}
+		originalConnection, err := net.Dial("unix", p.originalSocketFile)
+		if err != nil {
+			log.Errorf("Cannot establish connection to original %v socket: %v", p.name, err)
+			proxyConnection.Close()
+			if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT) {
+				select {
+				case p.gone <- true:
+				default:
+				}
+			}
+			continue
+		}
+
+		handle(proxyConnection, originalConnection)
+	}
+}
+
+// replaced tells whether somebody else created a new socket in place of the proxy
+func (p *socketProxy) replaced() bool {
+	inode, err := socketInode(p.socketFile)
+	return err != nil || inode != p.inode
+}
+
+// stop closes the proxy, and moves the original socket back in place,
+// unless the proxy was replaced meanwhile, in which case the original socket is stale and is removed
+func (p *socketProxy) stop() {
+	if p.replaced() {
+		p.listener.SetUnlinkOnClose(false)
+		if err := p.listener.Close(); err != nil {
+			log.Errorf("Cannot cleanup proxy %v socket: %v", p.name, err)
+		}
+		if err := os.Remove(p.originalSocketFile); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Cannot remove stale original %v socket: %v", p.name, err)
+		}
+		return
+	}
+
+	if err := p.listener.Close(); err != nil {
+		log.Errorf("Cannot cleanup proxy %v socket: %v", p.name, err)
+	}
+	if err := os.Rename(p.originalSocketFile, p.socketFile); err != nil {
+		log.Errorf("Cannot restore original %v socket: %v", p.name, err)
+	}
+}
+
+func socketInode(socketFile string) (uint64, error) {
+	info, err := os.Stat(socketFile)
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// proxySocket keeps a socket proxied until the app exits. Whenever somebody else creates the socket anew,
+// e.g. ssh binding a forwarded socket on every connection or gpg-agent creating its sockets when it restarts,
+// the proxy follows it. When the original socket is gone, it is put back in place, so that gpg can notice
+// that the agent is not running and start it again.
+func proxySocket(name string, socketFile string, exitKey string, exits *sync.Map, handle func(client net.Conn, original net.Conn)) {
+	var proxy *socketProxy
+	proxyMutex := sync.Mutex{}
+	gone := make(chan bool, 1)
+
+	follow := func() {
+		proxyMutex.Lock()
+		defer proxyMutex.Unlock()
+
+		if proxy != nil {
+			if !proxy.replaced() {
+				return
+			}
+			log.Debugf("%v socket '%v' was replaced, following it", name, socketFile)
+			proxy.stop()
+			proxy = nil
+		}
+
+		if _, err := os.Stat(socketFile); err != nil {
+			log.Debugf("%v socket '%v' does not exist yet", name, socketFile)
+			return
+		}
+		var err error
+		if proxy, err = startSocketProxy(name, socketFile, handle, gone); err != nil {
+			log.Errorf("Cannot watch %v: %v", name, err)
+		}
+	}
+
+	stepAside := func() {
+		proxyMutex.Lock()
+		defer proxyMutex.Unlock()
+
+		if proxy != nil && !proxy.replaced() {
+			log.Debugf("Original %v socket '%v' is gone, waiting for it to be created anew", name, socketFile)
+			proxy.stop()
+			proxy = nil
+		}
+	}
+
+	exit := make(chan bool)
+	exits.Store(exitKey, exit)
+	go func() {
+		<-exit
+		proxyMutex.Lock()
+		if proxy != nil {
+			proxy.stop()
+		}
+		exit <- true
+	}()
+
+	events := initInotifyWatcher(name, path.Dir(socketFile), notify.InCreate)
+	follow()
+
+	go func() {
+		defer notify.Stop(events)
+		for {
+			select {
+			case event := <-events:
+				if path.Base(event.Path()) == path.Base(socketFile) {
+					follow()
+				}
+			case <-gone:
+				stepAside()
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package detector
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// watcherRegistry makes sure a device node is read by exactly one watcher, however many times it is discovered
+type watcherRegistry struct {
+	name     string
+	mutex    sync.Mutex
+	watchers map[string]notifier.Device
+}
+
+func newWatcherRegistry(name string) *watcherRegistry {
+	return &watcherRegistry{name: name, watchers: make(map[string]notifier.Device)}
+}
+
+// claim reserves a device for a new watcher, it returns false when the device is already watched
+func (r *watcherRegistry) claim(device notifier.Device) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.watchers[device.Path]; ok {
+		log.Debugf("%v watcher for '%v' (%v) is already running", r.name, device.Path, device)
+		return false
+	}
+	r.watchers[device.Path] = device
+	r.logActive()
+	return true
+}
+
+// release forgets the watcher of a device once it stopped
+func (r *watcherRegistry) release(device notifier.Device) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.watchers[device.Path]; !ok {
+		return
+	}
+	delete(r.watchers, device.Path)
+	r.logActive()
+}
+
+// watching tells whether a watcher is running for any device node of the key with the given identity
+func (r *watcherRegistry) watching(identity string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, device := range r.watchers {
+		if device.Identity() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *watcherRegistry) list() []notifier.Device {
+	devices := make([]notifier.Device, 0, len(r.watchers))
+	for _, device := range r.watchers {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(a, b int) bool { return devices[a].Path < devices[b].Path })
+	return devices
+}
+
+func (r *watcherRegistry) logActive() {
+	paths := []string{}
+	for _, device := range r.list() {
+		paths = append(paths, device.Path)
+	}
+	log.Debugf("Active %v watchers: %v", r.name, paths)
+}
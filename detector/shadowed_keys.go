@@ -0,0 +1,137 @@
+package detector
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rjeczalik/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+// ShadowedKeys keeps track of the private key files that are only stubs of keys stored on a card,
+// as they are created (e.g. by gpg --card-status or a key import), replaced and removed
+type ShadowedKeys struct {
+	dir         string
+	mutex       sync.Mutex
+	files       map[string]string // the application identifier of the card each key is stored on, if known
+	subscribers []chan bool
+}
+
+// WatchShadowedKeys starts following the shadowed private keys in a private-keys-v1.d directory, even if it does not exist yet
+func WatchShadowedKeys(dir string) *ShadowedKeys {
+	keys := &ShadowedKeys{dir: dir, files: make(map[string]string)}
+	go keys.watch()
+	return keys
+}
+
+func (k *ShadowedKeys) watch() {
+	waitForDir(k.dir)
+
+	events := initInotifyWatcher("GPG keys", k.dir, notify.InCreate, notify.InCloseWrite, notify.InMovedTo, notify.InMovedFrom, notify.InDelete)
+	defer notify.Stop(events)
+
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		log.Errorf("Cannot list private keys in '%v': %v", k.dir, err)
+	}
+	for _, entry := range entries {
+		k.update(path.Join(k.dir, entry.Name()))
+	}
+
+	for event := range events {
+		k.update(path.Join(k.dir, path.Base(event.Path())))
+	}
+}
+
+// update checks again whether a key file is a shadowed key, and tells the subscribers about it
+func (k *ShadowedKeys) update(file string) {
+	if !strings.HasSuffix(file, ".key") {
+		return
+	}
+	shadowed, aid := readShadowedKeyFile(file)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if _, known := k.files[file]; !known && !shadowed {
+		return
+	}
+
+	// A shadowed key file that was written again may be a new file, whose watches need to be established again
+	if shadowed {
+		log.Debugf("Found shadowed private key '%v' on card '%v'", file, aid)
+		k.files[file] = aid
+	} else {
+		log.Debugf("Shadowed private key '%v' is gone", file)
+		delete(k.files, file)
+	}
+
+	for _, changes := range k.subscribers {
+		select {
+		case changes <- true:
+		default:
+		}
+	}
+}
+
+// readShadowedKeyFile tells whether a key file is a shadowed key, and which card it is stored on
+func readShadowedKeyFile(file string) (bool, string) {
+	data, err := os.ReadFile(file)
+	if err != nil || !strings.Contains(string(data), "shadowed-private-key") {
+		return false, ""
+	}
+	return true, findOpenPGPAID(string(data))
+}
+
+// Files lists the shadowed private key files
+func (k *ShadowedKeys) Files() []string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	files := make([]string, 0, len(k.files))
+	for file := range k.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// isShadowed tells whether a keygrip belongs to a key stored on a card
+func (k *ShadowedKeys) isShadowed(keygrip string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	_, shadowed := k.files[k.keyFile(keygrip)]
+	return shadowed
+}
+
+// cardSerial tells the serial number of the card a key is stored on, if known
+func (k *ShadowedKeys) cardSerial(keygrip string) string {
+	if k == nil || keygrip == "" {
+		return ""
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return cardSerial(k.files[k.keyFile(keygrip)])
+}
+
+func (k *ShadowedKeys) keyFile(keygrip string) string {
+	return path.Join(k.dir, strings.ToUpper(keygrip)+".key")
+}
+
+// subscribe returns a channel that receives a value whenever the shadowed private keys change
+func (k *ShadowedKeys) subscribe() chan bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	changes := make(chan bool, 1)
+	k.subscribers = append(k.subscribers, changes)
+	return changes
+}
+
+// WaitForAny blocks until at least one shadowed private key exists
+func (k *ShadowedKeys) WaitForAny() {
+	changes := k.subscribe()
+	for len(k.Files()) == 0 {
+		<-changes
+	}
+}
@@ -1,125 +1,291 @@
 package detector
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
 	"net"
 	"os"
-	"os/exec"
-	"path"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
 )
 
-// WatchSSH watches for hints that YubiKey is maybe waiting for a touch on a SSH auth request
-func WatchSSH(requestGPGCheck chan bool, exits *sync.Map) {
-	socketFile := os.Getenv("SSH_AUTH_SOCK")
+const (
+	// https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent
+	SSH_AGENT_FAILURE          = 5
+	SSH_AGENTC_SIGN_REQUEST    = 13
+	SSH_AGENT_SIGN_RESPONSE    = 14
+	SSH_AGENT_MAX_MESSAGE_SIZE = 256 * 1024
 
-	if socketFile == "" {
-		gpgAgentSocket, err := exec.Command("gpgconf", "--list-dirs", "agent-ssh-socket").CombinedOutput()
-		gpgAgentSocketOutput := strings.TrimSpace(string(gpgAgentSocket))
-		if err != nil {
-			log.Errorf("Cannot find SSH socket using gpgconf, error: %v, stderr: %v", err, gpgAgentSocketOutput)
-		} else {
-			socketFile = gpgAgentSocketOutput
-		}
+	// Keys of FIDO authenticators, whose touch is detected by the U2F detector
+	SSH_KEY_TYPE_SECURITY_KEY_PREFIX = "sk-"
+)
+
+// WatchSSH proxies the SSH agent socket of a home, and reports a wait for every signature made with a key stored on a card,
+// signatures with keys the agent does not know yet are checked by probing the card
+func WatchSSH(home GPGHome, agent *GPGAgent, keyring *GPGKeyring, policies *CardTouchPolicies, requestGPGCheck chan GPGCheckRequest, waits *GPGWaits, exits *sync.Map) {
+	// $SSH_AUTH_SOCK points to a single agent, which is assumed to be the one of the default home
+	socketFile := ""
+	if home.Default {
+		socketFile = os.Getenv("SSH_AUTH_SOCK")
 	}
 
 	if socketFile == "" {
-		runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
-		if runtimeDir != "" {
-			socketFile = path.Join(runtimeDir, "gnupg/S.gpg-agent.ssh")
-		}
+		socketFile = home.findAgentSocket("agent-ssh-socket", "S.gpg-agent.ssh")
 	}
 
 	if socketFile == "" {
-		log.Error("Cannot watch SSH. $SSH_AUTH_SOCK is not defined, gpgconf --list-dirs agent-ssh-socket didn't help, and $XDG_RUNTIME_DIR is not defined.")
+		log.Errorf("Cannot watch SSH of '%v'. $SSH_AUTH_SOCK is not defined, gpgconf --list-dirs agent-ssh-socket didn't help, and $XDG_RUNTIME_DIR is not defined.", home)
 		return
 	}
 
-	if _, err := os.Stat(socketFile); err != nil {
-		log.Errorf("Cannot watch SSH, the socket '%v' does not exist: %v", socketFile, err)
-		return
-	}
+	keys := &sshKeys{agent: agent, keys: make(map[string]sshKey)}
+	keys.refresh()
+
+	proxySocket("SSH", socketFile, home.exitKey("detector/ssh"), exits, func(proxyConnection, originalConnection net.Conn) {
+		session := &sshSession{waits: waits, keys: keys, keyring: keyring, policies: policies, requestGPGCheck: requestGPGCheck}
+		go session.proxyRequests(proxyConnection, originalConnection)
+		go session.proxyResponses(originalConnection, proxyConnection)
+	})
+}
 
-	originalSocketFile := socketFile + ".original"
-	if _, err := os.Stat(originalSocketFile); err == nil {
-		log.Warnf("'%v' already exists, assuming it's the correct one and trying to recover", originalSocketFile)
-		if err = os.Remove(socketFile); err != nil {
-			log.Errorf("Cannot remove '%v' in order to recover from possible previous crash", socketFile)
+// sshSession follows a single connection to the SSH agent, the agent answers the requests of a client one by one, in order
+type sshSession struct {
+	mutex           sync.Mutex
+	waits           *GPGWaits
+	keys            *sshKeys
+	keyring         *GPGKeyring
+	policies        *CardTouchPolicies
+	requestGPGCheck chan GPGCheckRequest
+	pending         []bool // whether each request awaiting an answer started a wait
+	waiting         bool
+	operation       notifier.Operation
+	card            string
+}
+
+// proxyRequests forwards what the client sends, and starts a wait when it asks for a signature with a key on a card
+func (s *sshSession) proxyRequests(client net.Conn, agent net.Conn) {
+	defer s.close(client, agent)
+
+	proxySSHMessages(client, agent, func(messageType byte, payload []byte) {
+		wait := messageType == SSH_AGENTC_SIGN_REQUEST && s.startWaiting(payload)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.pending = append(s.pending, wait)
+	})
+}
+
+// proxyResponses forwards what the agent sends, and stops a wait when the signature is made or refused
+func (s *sshSession) proxyResponses(agent net.Conn, client net.Conn) {
+	defer s.close(agent, client)
+
+	proxySSHMessages(agent, client, func(messageType byte, payload []byte) {
+		s.mutex.Lock()
+		if len(s.pending) == 0 {
+			s.mutex.Unlock()
 			return
 		}
-	} else {
-		if err := os.Rename(socketFile, originalSocketFile); err != nil {
-			log.Error("Cannot move original SSH socket file to setup a proxy: ", err)
-			return
+		wait := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mutex.Unlock()
+
+		if wait {
+			if messageType != SSH_AGENT_SIGN_RESPONSE && messageType != SSH_AGENT_FAILURE {
+				log.Debugf("SSH agent answered a sign request with message %v", messageType)
+			}
+			s.stopWaiting(messageType == SSH_AGENT_SIGN_RESPONSE)
 		}
+	})
+}
+
+// startWaiting starts a wait for a sign request, unless its key is known not to need a touch
+func (s *sshSession) startWaiting(payload []byte) bool {
+	keyBlob, ok := readSSHString(payload)
+	if !ok {
+		return false
+	}
+	keyType, _ := readSSHString(keyBlob)
+	if strings.HasPrefix(string(keyType), SSH_KEY_TYPE_SECURITY_KEY_PREFIX) {
+		return false
 	}
 
-	proxySocket, err := net.Listen("unix", socketFile)
-	if err != nil {
-		log.Error("Cannot establish a proxy SSH socket: ", err)
-		if err := os.Rename(originalSocketFile, socketFile); err != nil {
-			log.Error("Cannot restore original SSH socket: ", err)
+	fingerprint := sshFingerprint(keyBlob)
+	key, known := s.keys.lookup(fingerprint)
+	if !known {
+		// Whether the key is on a card is not known yet, the card tells whether it is busy
+		log.Debugf("SSH agent is asked to sign with unknown key '%v', checking the card", fingerprint)
+		select {
+		case s.requestGPGCheck <- GPGCheckRequest{}:
+		default:
 		}
+		return false
+	}
+	if !key.onCard {
+		log.Debugf("SSH agent is asked to sign with key '%v' which is not on a card", fingerprint)
+		return false
+	}
+
+	operation, gpgKey := s.keyring.describe(key.keygrip, notifier.OPERATION_AUTHENTICATE)
+	if !s.policies.needsTouch(key.serial, operation) {
+		log.Debugf("SSH agent is asked to sign with key '%v' which does not need a touch", fingerprint)
+		return false
+	}
+	if cachedUntil := s.policies.cachedUntil(key.serial, operation); !cachedUntil.IsZero() {
+		log.Debugf("SSH agent is asked to sign with key '%v' whose touch is cached for %v", fingerprint, time.Until(cachedUntil).Round(time.Second))
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.waiting {
+		return false
+	}
+	s.waiting = true
+	s.operation = operation
+	s.card = key.serial
+	s.waits.start(notifier.Event{Operation: operation, GPGKey: gpgKey, TouchPolicy: s.policies.of(key.serial, operation), CardSerial: key.serial, Device: inventory.findCard(key.serial), State: gpgWaitState()})
+	return true
+}
+
+// stopWaiting ends the wait for a signature, which was touched when the signature was made
+func (s *sshSession) stopWaiting(touched bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.waiting {
 		return
 	}
-	log.Debug("SSH watcher is successfully established")
+	s.waiting = false
 
-	exit := make(chan bool)
-	exits.Store("detector/ssh", exit)
-	go func() {
-		<-exit
-		if err := proxySocket.Close(); err != nil {
-			log.Error("Cannot cleanup proxy SSH socket: ", err)
-		}
-		if err := os.Rename(originalSocketFile, socketFile); err != nil {
-			log.Error("Cannot restore original SSH socket: ", err)
-		}
-		exit <- true
-	}()
+	var cachedUntil time.Time
+	if touched {
+		cachedUntil = s.policies.touched(s.card, s.operation)
+	}
+	s.waits.stop(cachedUntil)
+}
 
+func (s *sshSession) close(reader net.Conn, writer net.Conn) {
+	reader.Close()
+	writer.Close()
+	s.stopWaiting(false)
+}
+
+// proxySSHMessages forwards data message by message, letting onMessage inspect each message before it is sent further.
+// A message is a 4 bytes long big-endian length, followed by the message type and its payload.
+func proxySSHMessages(reader io.Reader, writer io.Writer, onMessage func(messageType byte, payload []byte)) {
+	header := make([]byte, 4)
 	for {
-		proxyConnection, err := proxySocket.Accept()
-		if err != nil {
-			if !strings.Contains(err.Error(), "use of closed network connection") {
-				log.Error("Cannot accept incoming proxy connection: ", err)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || length > SSH_AGENT_MAX_MESSAGE_SIZE {
+			// Not the SSH agent protocol, or not understood, just pass everything through
+			log.Debugf("Unexpected SSH agent message length %v, not following the conversation anymore", length)
+			if _, err := writer.Write(header); err == nil {
+				io.Copy(writer, reader)
 			}
 			return
 		}
-		originalConnection, err := net.Dial("unix", originalSocketFile)
-		if err != nil {
-			log.Error("Cannot establish connection to original socket: ", err)
-			proxyConnection.Close()
+
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
 			return
 		}
+		onMessage(message[0], message[1:])
 
-		go proxyUnixSocket(proxyConnection, originalConnection, requestGPGCheck)
-		go proxyUnixSocket(originalConnection, proxyConnection, requestGPGCheck)
+		if _, err := writer.Write(append(header, message...)); err != nil {
+			return
+		}
 	}
 }
 
-func proxyUnixSocket(reader net.Conn, writer net.Conn, requestGPGCheck chan bool) {
-	defer (func() {
-		reader.Close()
-		writer.Close()
-	})()
+// readSSHString reads a string of the SSH wire format, a 4 bytes long big-endian length followed by as many bytes
+func readSSHString(data []byte) ([]byte, bool) {
+	if len(data) < 4 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, false
+	}
+	return data[4 : 4+length], true
+}
 
-	buf := make([]byte, 10240)
-	for {
-		nr, err := reader.Read(buf)
-		if err != nil {
-			return
-		}
+// sshFingerprint computes the fingerprint of a public key, as ssh-keygen -l shows it
+func sshFingerprint(keyBlob []byte) string {
+	hash := sha256.Sum256(keyBlob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
 
-		data := buf[0:nr]
-		if _, err = writer.Write(data); err != nil {
-			return
-		}
+// sshKey is what gpg-agent tells about a key it knows
+type sshKey struct {
+	keygrip string
+	onCard  bool
+	serial  string
+}
 
-		select {
-		case requestGPGCheck <- true:
-		default:
+// sshKeys maps the fingerprints of SSH keys to the keys gpg-agent knows
+type sshKeys struct {
+	agent     *GPGAgent
+	mutex     sync.Mutex
+	keys      map[string]sshKey
+	loaded    time.Time
+	reloading bool
+}
+
+// lookup finds the key of a fingerprint, and asks the agent about its keys again in the background if it is not known yet
+func (k *sshKeys) lookup(fingerprint string) (sshKey, bool) {
+	k.mutex.Lock()
+	key, ok := k.keys[fingerprint]
+	k.mutex.Unlock()
+
+	if !ok {
+		k.refresh()
+	}
+	return key, ok
+}
+
+// refresh reloads the keys in the background, unless they were reloaded recently,
+// so that the messages of the clients are not held while the agent answers
+func (k *sshKeys) refresh() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.agent == nil || k.reloading || time.Since(k.loaded) < GPG_KEYRING_RELOAD_INTERVAL {
+		return
+	}
+	k.loaded = time.Now()
+	k.reloading = true
+	go k.reload()
+}
+
+func (k *sshKeys) reload() {
+	// S KEYINFO <keygrip> <type> <serialno> <idstr> <cached> <protection> <fpr> <ttl> <flags>
+	keys := make(map[string]sshKey)
+	err := k.agent.send("KEYINFO --list --ssh-fpr=sha256", 10*time.Second, func(status, args string) error {
+		fields := strings.Fields(args)
+		if status != "KEYINFO" || len(fields) < 7 || fields[6] == "-" {
+			return nil
 		}
+		keys[fields[6]] = sshKey{keygrip: fields[0], onCard: fields[1] == "T", serial: cardSerial(fields[2])}
+		return nil
+	})
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.reloading = false
+	if err != nil {
+		log.Errorf("Cannot list the keys of gpg-agent: %v", err)
+		return
 	}
+
+	k.keys = keys
+	log.Debugf("Found %v SSH keys in gpg-agent", len(k.keys))
 }
@@ -0,0 +1,164 @@
+package detector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	sshAgentcRequestIdentities = 11
+	sshAgentIdentitiesAnswer   = 12
+)
+
+func sshString(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+func sshMessage(messageType byte, payload []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1)), append([]byte{messageType}, payload...)...)
+}
+
+func TestReadSSHString(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		value []byte
+		ok    bool
+	}{
+		{name: "string", data: sshString([]byte("ssh-ed25519")), value: []byte("ssh-ed25519"), ok: true},
+		{name: "followed by more data", data: append(sshString([]byte("key")), 0x01, 0x02), value: []byte("key"), ok: true},
+		{name: "empty string", data: sshString(nil), value: []byte{}, ok: true},
+		{name: "truncated length", data: []byte{0x00, 0x00, 0x01}},
+		{name: "truncated string", data: sshString([]byte("ssh-ed25519"))[:8]},
+		{name: "oversized length", data: []byte{0xff, 0xff, 0xff, 0xff, 0x00}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok := readSSHString(test.data)
+			if ok != test.ok || !bytes.Equal(value, test.value) {
+				t.Errorf("Expected %q, %v, got %q, %v", test.value, test.ok, value, ok)
+			}
+		})
+	}
+}
+
+func TestProxySSHMessages(t *testing.T) {
+	identities := sshMessage(sshAgentcRequestIdentities, nil)
+	signRequest := sshMessage(SSH_AGENTC_SIGN_REQUEST, sshString([]byte("key")))
+	oversized := binary.BigEndian.AppendUint32(nil, SSH_AGENT_MAX_MESSAGE_SIZE+1)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		oneByte  bool
+		messages []byte // the type of each message that was inspected
+		output   []byte
+	}{
+		{
+			name:     "messages",
+			input:    append(append([]byte{}, identities...), signRequest...),
+			messages: []byte{sshAgentcRequestIdentities, SSH_AGENTC_SIGN_REQUEST},
+			output:   append(append([]byte{}, identities...), signRequest...),
+		},
+		{
+			name:     "messages split across reads",
+			input:    append(append([]byte{}, identities...), signRequest...),
+			oneByte:  true,
+			messages: []byte{sshAgentcRequestIdentities, SSH_AGENTC_SIGN_REQUEST},
+			output:   append(append([]byte{}, identities...), signRequest...),
+		},
+		{
+			name:     "truncated message",
+			input:    append(append([]byte{}, identities...), signRequest[:len(signRequest)-1]...),
+			messages: []byte{sshAgentcRequestIdentities},
+			output:   identities,
+		},
+		{
+			name:     "oversized length",
+			input:    append(append(append([]byte{}, identities...), oversized...), signRequest...),
+			messages: []byte{sshAgentcRequestIdentities},
+			output:   append(append(append([]byte{}, identities...), oversized...), signRequest...),
+		},
+		{
+			name:     "zero length",
+			input:    append([]byte{0x00, 0x00, 0x00, 0x00}, signRequest...),
+			messages: nil,
+			output:   append([]byte{0x00, 0x00, 0x00, 0x00}, signRequest...),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reader io.Reader = bytes.NewReader(test.input)
+			if test.oneByte {
+				reader = iotest.OneByteReader(reader)
+			}
+			var output bytes.Buffer
+			var messages []byte
+			proxySSHMessages(reader, &output, func(messageType byte, payload []byte) {
+				messages = append(messages, messageType)
+			})
+
+			if !bytes.Equal(messages, test.messages) {
+				t.Errorf("Expected messages %v, got %v", test.messages, messages)
+			}
+			if !bytes.Equal(output.Bytes(), test.output) {
+				t.Errorf("Expected output %x, got %x", test.output, output.Bytes())
+			}
+		})
+	}
+}
+
+func TestSSHSessionPairsSignRequestsWithResponses(t *testing.T) {
+	cardKey := sshString([]byte("ssh-rsa card key"))
+	diskKey := sshString([]byte("ssh-rsa disk key"))
+	keys := &sshKeys{keys: map[string]sshKey{
+		sshFingerprint(cardKey[4:]): {keygrip: "CARD", onCard: true},
+		sshFingerprint(diskKey[4:]): {keygrip: "DISK", onCard: false},
+	}}
+
+	events := make(chan notifier.Event, 10)
+	notifiers := &sync.Map{}
+	notifiers.Store("test", events)
+	session := &sshSession{waits: NewGPGWaits(GPGHome{Dir: "test"}, notifiers), keys: keys}
+
+	client, proxyClient := net.Pipe()
+	proxyAgent, agent := net.Pipe()
+	go session.proxyRequests(proxyClient, proxyAgent)
+	go session.proxyResponses(proxyAgent, proxyClient)
+	t.Cleanup(func() {
+		client.Close()
+		agent.Close()
+	})
+
+	// Forwards a message in one direction and makes sure it arrives unchanged
+	forward := func(from net.Conn, to net.Conn, message []byte) {
+		t.Helper()
+		go from.Write(message)
+		received := make([]byte, len(message))
+		if _, err := io.ReadFull(to, received); err != nil || !bytes.Equal(received, message) {
+			t.Fatalf("Expected %x to be forwarded, got %x (%v)", message, received, err)
+		}
+	}
+
+	// Requests are answered in order, only the answer to the sign request with the card key ends the wait
+	forward(client, agent, sshMessage(sshAgentcRequestIdentities, nil))
+	forward(client, agent, sshMessage(SSH_AGENTC_SIGN_REQUEST, append(diskKey, sshString([]byte("data"))...)))
+	forward(client, agent, sshMessage(SSH_AGENTC_SIGN_REQUEST, append(cardKey, sshString([]byte("data"))...)))
+	expectEvents(t, events, notifier.Event{Message: notifier.GPG_ON, Operation: notifier.OPERATION_AUTHENTICATE, State: notifier.STATE_TOUCH})
+
+	forward(agent, client, sshMessage(sshAgentIdentitiesAnswer, nil))
+	forward(agent, client, sshMessage(SSH_AGENT_SIGN_RESPONSE, sshString([]byte("disk signature"))))
+	expectNoMoreEvents(t, events)
+
+	forward(agent, client, sshMessage(SSH_AGENT_SIGN_RESPONSE, sshString([]byte("card signature"))))
+	expectEvents(t, events, notifier.Event{Message: notifier.GPG_OFF})
+}
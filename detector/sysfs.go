@@ -0,0 +1,99 @@
+package detector
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	// https://www.usb.org/defined-class-codes
+	USB_VENDOR_YUBICO             = 0x1050
+	USB_INTERFACE_CLASS_HID       = 0x03
+	USB_INTERFACE_CLASS_SMARTCARD = 0x0b
+	USB_INTERFACE_PROTOCOL_KBD    = 0x01
+)
+
+// readHidrawDevice reads the identity of a hidraw device from the uevent of its HID parent,
+// and from the USB device it belongs to
+func readHidrawDevice(devicePath string) (notifier.Device, error) {
+	device := notifier.Device{Path: devicePath}
+
+	hidDir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/class/hidraw/%v/device", path.Base(devicePath)))
+	if err != nil {
+		return device, err
+	}
+
+	info, err := os.ReadFile(path.Join(hidDir, "uevent"))
+	if err != nil {
+		return device, err
+	}
+
+	for _, line := range strings.Split(string(info), "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "HID_ID":
+			// bus:vendor:product, e.g. 0003:00001050:00000407
+			if ids := strings.Split(value, ":"); len(ids) == 3 {
+				vendorID, _ := strconv.ParseUint(ids[1], 16, 32)
+				productID, _ := strconv.ParseUint(ids[2], 16, 32)
+				device.VendorID = uint16(vendorID)
+				device.ProductID = uint16(productID)
+			}
+		case "HID_NAME":
+			device.Name = value
+		case "HID_UNIQ":
+			device.Serial = value
+		}
+	}
+
+	// hidraw -> HID device -> USB interface -> USB device
+	usbInterfaceDir := path.Dir(hidDir)
+	if sysfsExists(usbInterfaceDir, "bInterfaceNumber") {
+		device.Interface = readUSBInterfaceKind(usbInterfaceDir)
+
+		usbDeviceDir := path.Dir(usbInterfaceDir)
+		if sysfsExists(usbDeviceDir, "idVendor") {
+			device.SysfsPath = usbDeviceDir
+			if serial := readSysfsAttribute(usbDeviceDir, "serial"); serial != "" {
+				device.Serial = serial
+			}
+		}
+	}
+
+	return device, nil
+}
+
+// readUSBInterfaceKind tells which YubiKey application is behind a USB interface
+func readUSBInterfaceKind(usbInterfaceDir string) string {
+	class, _ := strconv.ParseUint(readSysfsAttribute(usbInterfaceDir, "bInterfaceClass"), 16, 8)
+	protocol, _ := strconv.ParseUint(readSysfsAttribute(usbInterfaceDir, "bInterfaceProtocol"), 16, 8)
+
+	switch {
+	case class == USB_INTERFACE_CLASS_HID && protocol == USB_INTERFACE_PROTOCOL_KBD:
+		return notifier.INTERFACE_OTP
+	case class == USB_INTERFACE_CLASS_HID:
+		return notifier.INTERFACE_FIDO
+	case class == USB_INTERFACE_CLASS_SMARTCARD:
+		return notifier.INTERFACE_CCID
+	}
+	return ""
+}
+
+func readSysfsAttribute(dir string, attribute string) string {
+	value, err := os.ReadFile(path.Join(dir, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+func sysfsExists(dir string, attribute string) bool {
+	_, err := os.Stat(path.Join(dir, attribute))
+	return err == nil
+}
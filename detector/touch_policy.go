@@ -0,0 +1,135 @@
+package detector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+// How long a card with a cached touch policy accepts operations without a touch, after the last touch
+const TOUCH_CACHE_DURATION = 15 * time.Second
+
+// https://developers.yubico.com/PGP/Card_edit.html and the OpenPGP card spec, user interaction flag data objects
+var uifTouchPolicies = map[byte]notifier.TouchPolicy{
+	0x00: notifier.TOUCH_POLICY_OFF,
+	0x01: notifier.TOUCH_POLICY_ON,
+	0x02: notifier.TOUCH_POLICY_FIXED,
+	0x03: notifier.TOUCH_POLICY_CACHED,
+	0x04: notifier.TOUCH_POLICY_CACHED_FIXED,
+}
+
+// uifAttributes are the user interaction flags of the signature, decryption and authentication slots of the card
+var uifAttributes = map[notifier.Operation]string{
+	notifier.OPERATION_SIGN:         "UIF-1",
+	notifier.OPERATION_DECRYPT:      "UIF-2",
+	notifier.OPERATION_AUTHENTICATE: "UIF-3",
+}
+
+// CardTouchPolicies remembers the touch policy of each slot of the OpenPGP cards, by card serial number,
+// and when each slot was last touched
+type CardTouchPolicies struct {
+	mutex       sync.RWMutex
+	policies    map[string]map[notifier.Operation]notifier.TouchPolicy
+	lastTouches map[string]map[notifier.Operation]time.Time
+}
+
+func NewCardTouchPolicies() *CardTouchPolicies {
+	return &CardTouchPolicies{
+		policies:    make(map[string]map[notifier.Operation]notifier.TouchPolicy),
+		lastTouches: make(map[string]map[notifier.Operation]time.Time),
+	}
+}
+
+// of returns the touch policy of the slot of a card used for an operation, if known
+func (p *CardTouchPolicies) of(card string, operation notifier.Operation) notifier.TouchPolicy {
+	if p == nil {
+		return notifier.TOUCH_POLICY_UNKNOWN
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.policies[card][operation]
+}
+
+// read asks scdaemon for the user interaction flags of the card that is currently inserted, whose serial number is given
+func (p *CardTouchPolicies) read(agent *GPGAgent, card string) {
+	policies := make(map[notifier.Operation]notifier.TouchPolicy)
+	for operation, attribute := range uifAttributes {
+		err := agent.send("SCD GETATTR "+attribute, 0, func(status, args string) error {
+			if status != attribute {
+				return nil
+			}
+			flags := assuanUnescape(args)
+			if len(flags) == 0 {
+				return fmt.Errorf("empty %v", attribute)
+			}
+			if policy, ok := uifTouchPolicies[flags[0]]; ok {
+				policies[operation] = policy
+			}
+			return nil
+		})
+		if err != nil {
+			log.Debugf("Cannot read touch policy %v of the card: %v", attribute, err)
+		}
+	}
+
+	p.mutex.Lock()
+	p.policies[card] = policies
+	p.lastTouches[card] = make(map[notifier.Operation]time.Time)
+	p.mutex.Unlock()
+
+	var description []string
+	for _, operation := range []notifier.Operation{notifier.OPERATION_SIGN, notifier.OPERATION_DECRYPT, notifier.OPERATION_AUTHENTICATE} {
+		description = append(description, fmt.Sprintf("%v=%v", operation, orUnknown(string(policies[operation]))))
+	}
+	log.Debugf("Touch policies of the card %v: %v", orUnknown(card), strings.Join(description, ", "))
+}
+
+// needsTouch tells whether an operation may wait for a touch, i.e. unless its slot is known to have touch disabled
+func (p *CardTouchPolicies) needsTouch(card string, operation notifier.Operation) bool {
+	return p.of(card, operation) != notifier.TOUCH_POLICY_OFF
+}
+
+// touched records that the slot of a card used for an operation was just touched,
+// and returns until when the touch is cached, or zero time if the slot does not cache touches
+func (p *CardTouchPolicies) touched(card string, operation notifier.Operation) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	policy := p.policies[card][operation]
+	if policy != notifier.TOUCH_POLICY_CACHED && policy != notifier.TOUCH_POLICY_CACHED_FIXED {
+		return time.Time{}
+	}
+	now := time.Now()
+	p.lastTouches[card][operation] = now
+	return now.Add(TOUCH_CACHE_DURATION)
+}
+
+// cachedUntil tells until when the touch of the slot of a card used for an operation is cached, or zero time if it is not
+func (p *CardTouchPolicies) cachedUntil(card string, operation notifier.Operation) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	lastTouch, ok := p.lastTouches[card][operation]
+	if !ok || time.Since(lastTouch) >= TOUCH_CACHE_DURATION {
+		return time.Time{}
+	}
+	return lastTouch.Add(TOUCH_CACHE_DURATION)
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
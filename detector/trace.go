@@ -0,0 +1,227 @@
+package detector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	TRACE_FORMAT_VERSION = 1
+	TRACE_ENTRY_DEVICE   = "device"
+	TRACE_ENTRY_REPORT   = "report"
+)
+
+// traceEntry is a single line of a trace file, either a device description or an input report it sent
+type traceEntry struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+
+	// Offset from the beginning of the recording, in microseconds
+	Offset int64 `json:"offset_us"`
+
+	// Device descriptions only
+	Version    int    `json:"version,omitempty"`
+	VendorID   uint16 `json:"vendor_id,omitempty"`
+	ProductID  uint16 `json:"product_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Uevent     string `json:"uevent,omitempty"`
+	Descriptor string `json:"descriptor,omitempty"`
+	ReportSize int    `json:"report_size,omitempty"`
+
+	// Input reports only
+	Report string `json:"report,omitempty"`
+}
+
+// RecordU2F captures input reports of all connected FIDO devices into a trace file, until the devices disappear
+func RecordU2F(output io.Writer, filter DeviceFilter) error {
+	devices, err := os.ReadDir("/dev")
+	if err != nil {
+		return fmt.Errorf("cannot list devices in '/dev': %v", err)
+	}
+
+	encoder := json.NewEncoder(output)
+	encoderMutex := sync.Mutex{}
+	start := time.Now()
+	write := func(entry traceEntry) {
+		encoderMutex.Lock()
+		defer encoderMutex.Unlock()
+		entry.Offset = time.Since(start).Microseconds()
+		if err := encoder.Encode(entry); err != nil {
+			log.Errorf("Cannot write trace: %v", err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, device := range devices {
+		devicePath := path.Join("/dev", device.Name())
+		isFido, reportSize := isFidoU2FDevice(devicePath)
+		if !isFido {
+			continue
+		}
+
+		hidrawDevice, err := readHidrawDevice(devicePath)
+		if err != nil {
+			log.Debugf("Cannot identify FIDO device '%v': %v", devicePath, err)
+		}
+		if !filter.allows(hidrawDevice) {
+			log.Debugf("Not recording FIDO device '%v' (%v) as configured", devicePath, hidrawDevice.Name)
+			continue
+		}
+
+		// Devices that are being recorded already keep being recorded when another one fails
+		descriptor, err := readHidrawDescriptor(devicePath)
+		if err != nil {
+			log.Errorf("Not recording FIDO device '%v', cannot read its descriptor: %v", devicePath, err)
+			continue
+		}
+		uevent, _ := os.ReadFile(fmt.Sprintf("/sys/class/hidraw/%v/device/uevent", path.Base(devicePath)))
+
+		file, err := os.Open(devicePath)
+		if err != nil {
+			log.Errorf("Not recording FIDO device '%v', cannot open it: %v", devicePath, err)
+			continue
+		}
+
+		write(traceEntry{
+			Type:       TRACE_ENTRY_DEVICE,
+			Path:       devicePath,
+			Version:    TRACE_FORMAT_VERSION,
+			VendorID:   hidrawDevice.VendorID,
+			ProductID:  hidrawDevice.ProductID,
+			Name:       hidrawDevice.Name,
+			Serial:     hidrawDevice.Serial,
+			Uevent:     string(uevent),
+			Descriptor: hex.EncodeToString(descriptor),
+			ReportSize: reportSize,
+		})
+		log.Infof("Recording '%v' (%v)", devicePath, hidrawDevice.Name)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer file.Close()
+
+			payload := make([]byte, reportSize)
+			for {
+				n, err := file.Read(payload)
+				if err != nil {
+					log.Debugf("Stopped recording '%v': %v", devicePath, err)
+					return
+				}
+				write(traceEntry{Type: TRACE_ENTRY_REPORT, Path: devicePath, Report: hex.EncodeToString(payload[:n])})
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// ReplayU2F feeds a trace file through the U2F detector, respecting the original timing of the reports
+func ReplayU2F(input io.Reader, notifiers *sync.Map) error {
+	type replayedDevice struct {
+		device     notifier.Device
+		reportSize int
+		reports    []traceEntry
+	}
+
+	devices := make(map[string]*replayedDevice)
+	var order []string
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry traceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+
+		switch entry.Type {
+		case TRACE_ENTRY_DEVICE:
+			if entry.Version > TRACE_FORMAT_VERSION {
+				return fmt.Errorf("line %v: unsupported trace format version %v", line, entry.Version)
+			}
+			if entry.ReportSize <= 0 {
+				entry.ReportSize = CTAPHID_DEFAULT_REPORT
+			}
+			// A device described again, e.g. after it was plugged in anew, keeps the reports recorded so far
+			device, ok := devices[entry.Path]
+			if !ok {
+				device = &replayedDevice{}
+				devices[entry.Path] = device
+				order = append(order, entry.Path)
+			}
+			device.device = notifier.Device{
+				Path:      entry.Path,
+				VendorID:  entry.VendorID,
+				ProductID: entry.ProductID,
+				Name:      entry.Name,
+				Serial:    entry.Serial,
+			}
+			device.reportSize = entry.ReportSize
+		case TRACE_ENTRY_REPORT:
+			device, ok := devices[entry.Path]
+			if !ok {
+				return fmt.Errorf("line %v: report from '%v' which was not described", line, entry.Path)
+			}
+			device.reports = append(device.reports, entry)
+		default:
+			return fmt.Errorf("line %v: unknown entry type '%v'", line, entry.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for _, devicePath := range order {
+		device := devices[devicePath]
+		reader := &traceReader{start: start, reports: device.reports}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			noProcess := func(string) *notifier.Process { return nil }
+			watchU2FReports(device.device, reader, device.reportSize, notifiers, noProcess)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// traceReader returns recorded reports one per read, at the same pace they were recorded
+type traceReader struct {
+	start   time.Time
+	reports []traceEntry
+}
+
+func (r *traceReader) Read(payload []byte) (int, error) {
+	if len(r.reports) == 0 {
+		// Let the detector timers run out like they would on a real device
+		time.Sleep(3 * time.Second)
+		return 0, io.EOF
+	}
+
+	entry := r.reports[0]
+	r.reports = r.reports[1:]
+
+	time.Sleep(time.Until(r.start.Add(time.Duration(entry.Offset) * time.Microsecond)))
+
+	report, err := hex.DecodeString(entry.Report)
+	if err != nil {
+		return 0, fmt.Errorf("invalid report at %vus: %v", entry.Offset, err)
+	}
+	return copy(payload, report), nil
+}
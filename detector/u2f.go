@@ -1,6 +1,7 @@
 package detector
 
 import (
+	"io"
 	"os"
 	"path"
 	"strings"
@@ -21,13 +22,27 @@ const (
 	// https://fidoalliance.org/specs/fido2/fido-client-to-authenticator-protocol-v2.1-rd-20191217.html
 	TYPE_INIT          = 0x80
 	CTAPHID_MSG        = TYPE_INIT | 0x03
+	CTAPHID_CBOR       = TYPE_INIT | 0x10
 	CTAPHID_KEEPALIVE  = TYPE_INIT | 0x3b
 	FIDO_USAGE_PAGE    = 0xf1d0
 	FIDO_USAGE_CTAPHID = 0x01
+	STATUS_PROCESSING  = 0x01
 	STATUS_UPNEEDED    = 0x02
+	CTAP2_OK           = 0x00
 
 	// https://fidoalliance.org/specs/u2f-specs-master/inc/u2f.h
+	U2F_SW_NO_ERROR                 = 0x9000
 	U2F_SW_CONDITIONS_NOT_SATISFIED = 0x6985
+	U2F_REGISTER_ID                 = 0x05
+	U2F_AUTH_FLAG_TUP               = 0x01
+
+	// https://fidoalliance.org/specs/fido-v2.1-ps-20210615/fido-client-to-authenticator-protocol-v2.1-ps-20210615.html#authenticatorMakeCredential
+	// and #authenticatorGetAssertion, response map keys
+	CTAP2_MAKE_CREDENTIAL_FMT      = 0x01
+	CTAP2_MAKE_CREDENTIAL_ATT_STMT = 0x03
+	CTAP2_GET_ASSERTION_CREDENTIAL = 0x01
+	CTAP2_GET_ASSERTION_AUTH_DATA  = 0x02
+	CTAP2_GET_ASSERTION_SIGNATURE  = 0x03
 
 	// https://github.com/torvalds/linux/blob/master/include/linux/hid.h
 	HID_ITEM_TYPE_GLOBAL           = 1
@@ -48,40 +63,101 @@ type hidrawDescriptor struct {
 	Value [4096]uint8
 }
 
+// u2fWatchers keeps track of the FIDO devices that are being read
+var u2fWatchers = newWatcherRegistry("U2F")
+
+// u2fReaders are the running readers of FIDO devices, which stop once the stop channel is closed
+type u2fReaders struct {
+	stop    chan bool
+	running sync.WaitGroup
+}
+
 // WatchU2F watches when YubiKey is waiting for a touch on a U2F request
-func WatchU2F(notifiers *sync.Map) {
-	checkAndInitWatcher := func(devicePath string) {
-		if isFidoU2FDevice(devicePath) {
-			go runU2FWatcher(devicePath, notifiers)
-		}
-	}
+func WatchU2F(notifiers *sync.Map, filter DeviceFilter, exits *sync.Map) {
+	readers := &u2fReaders{stop: make(chan bool)}
+	exit := make(chan bool)
+	exits.Store("detector/u2f", exit)
 
 	devicesEvents := initInotifyWatcher("U2F", "/dev", notify.Create)
 	defer notify.Stop(devicesEvents)
 
 	if devices, err := os.ReadDir("/dev"); err == nil {
 		for _, device := range devices {
-			checkAndInitWatcher(path.Join("/dev", device.Name()))
+			startU2FWatcher(path.Join("/dev", device.Name()), filter, notifiers, readers)
 		}
 	} else {
 		log.Errorf("Cannot list devices in '/dev' to find connected YubiKeys: %v", err)
 	}
 
-	for event := range devicesEvents {
-		// Give a second for device to initialize before establishing a watcher
-		time.Sleep(1 * time.Second)
-		checkAndInitWatcher(event.Path())
+	for {
+		select {
+		case event := <-devicesEvents:
+			// Give a second for device to initialize before establishing a watcher
+			select {
+			case <-time.After(1 * time.Second):
+				startU2FWatcher(event.Path(), filter, notifiers, readers)
+			case <-exit:
+				readers.stopAll(exit)
+				return
+			}
+		case <-exit:
+			readers.stopAll(exit)
+			return
+		}
+	}
+}
+
+// stopAll stops every reader and confirms the exit once they are all gone
+func (r *u2fReaders) stopAll(exit chan bool) {
+	close(r.stop)
+	r.running.Wait()
+	exit <- true
+}
+
+// startU2FWatcher starts reading a FIDO device, unless it is already being read
+func startU2FWatcher(devicePath string, filter DeviceFilter, notifiers *sync.Map, readers *u2fReaders) {
+	isFido, reportSize := isFidoU2FDevice(devicePath)
+	if !isFido {
+		return
+	}
+
+	device, err := readHidrawDevice(devicePath)
+	if err != nil {
+		log.Debugf("Cannot identify FIDO device '%v': %v", devicePath, err)
+	}
+	if !filter.allows(device) {
+		log.Debugf("Ignoring FIDO device '%v' (%v) as configured", devicePath, device.Name)
+		return
+	}
+
+	if !u2fWatchers.claim(device) {
+		return
 	}
+	readers.running.Add(1)
+	go func() {
+		defer readers.running.Done()
+		runU2FWatcher(device, reportSize, notifiers, readers.stop)
+	}()
 }
 
-func isFidoU2FDevice(devicePath string) bool {
+// isFidoU2FDevice tells whether a device speaks CTAPHID, and if so, what is the size of its input reports
+func isFidoU2FDevice(devicePath string) (bool, int) {
 	if !strings.HasPrefix(devicePath, "/dev/hidraw") {
-		return false
+		return false, 0
+	}
+
+	descriptor, err := readHidrawDescriptor(devicePath)
+	if err != nil {
+		return false, 0
 	}
 
+	return parseFidoDescriptor(descriptor)
+}
+
+func readHidrawDescriptor(devicePath string) ([]byte, error) {
 	device, err := os.Open(devicePath)
 	if err != nil {
-		return false
+		return nil, err
 	}
 	defer device.Close()
 
@@ -89,73 +165,97 @@ func isFidoU2FDevice(devicePath string) bool {
 	err = ioctl.IOCTL(device.Fd(), HIDIOCGRDESCSIZE, uintptr(unsafe.Pointer(&size)))
 	if err != nil {
 		log.Warnf("Cannot get descriptor size for device '%v': %v", devicePath, err)
-		return false
+		return nil, err
 	}
 
 	data := hidrawDescriptor{Size: size}
 	err = ioctl.IOCTL(device.Fd(), HIDIOCGRDESC, uintptr(unsafe.Pointer(&data)))
 	if err != nil {
 		log.Warnf("Cannot get descriptor for device '%v': %v", devicePath, err)
-		return false
-	}
-
-	isFido := false
-	hasU2F := false
-	for i := uint32(0); i < size; {
-		prefix := data.Value[i]
-		tag := (prefix & 0b11110000) >> 4
-		typ := (prefix & 0b00001100) >> 2
-		size := prefix & 0b00000011
-
-		val1b := data.Value[i+1]
-		val2b := int(data.Value[i+1]) | (int(data.Value[i+2]) << 8)
-
-		if typ == HID_ITEM_TYPE_GLOBAL && tag == HID_GLOBAL_ITEM_TAG_USAGE_PAGE && val2b == FIDO_USAGE_PAGE {
-			isFido = true
-		} else if typ == HID_ITEM_TYPE_LOCAL && tag == HID_LOCAL_ITEM_TAG_USAGE && val1b == FIDO_USAGE_CTAPHID {
-			hasU2F = true
-		}
-
-		if isFido && hasU2F {
-			return true
-		}
-
-		i += uint32(size) + 1
+		return nil, err
 	}
 
-	return false
+	return data.Value[:size], nil
 }
 
-func runU2FWatcher(devicePath string, notifiers *sync.Map) {
-	device, err := os.Open(devicePath)
+func runU2FWatcher(hidrawDevice notifier.Device, reportSize int, notifiers *sync.Map, stop chan bool) {
+	device, err := os.Open(hidrawDevice.Path)
 	if err != nil {
-		log.Errorf("Cannot open device '%v' to run U2F watcher: %v", devicePath, err)
+		log.Errorf("Cannot open device '%v' to run U2F watcher: %v", hidrawDevice.Path, err)
+		u2fWatchers.release(hidrawDevice)
 		return
 	}
-	defer device.Close()
 
-	payload := make([]byte, 64)
+	// Closing the device makes the pending read fail, which ends the watcher
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		device.Close()
+	}()
+
+	inventory.interfaceAdded(notifiers, hidrawDevice)
+	watchU2FReports(hidrawDevice, device, reportSize, notifiers, findProcessUsingFile)
+	u2fWatchers.release(hidrawDevice)
+	inventory.interfaceRemoved(notifiers, hidrawDevice)
+}
+
+// watchU2FReports interprets input reports of a FIDO device, one report per read, until the reader fails
+func watchU2FReports(hidrawDevice notifier.Device, device io.Reader, reportSize int, notifiers *sync.Map, findProcess func(string) *notifier.Process) {
+	devicePath := hidrawDevice.Path
+	framer := newCtaphidFramer(reportSize)
+	payload := make([]byte, reportSize)
 	lastMessage := notifier.U2F_OFF
+	lastOperation := notifier.OPERATION_UNKNOWN
+	lastState := notifier.STATE_UNKNOWN
+	builtInUV := hasBuiltInUV(hidrawDevice)
+	var process *notifier.Process
 	var u2fOffTimer *time.Timer
+	waits := 0
+
+	// The state of the wait is shared with the U2F_OFF timer
+	var mutex sync.Mutex
+
 	for {
-		_, err = device.Read(payload)
+		n, err := device.Read(payload)
 		if err != nil {
+			mutex.Lock()
+			defer mutex.Unlock()
 			if u2fOffTimer != nil {
 				u2fOffTimer.Stop()
 			}
 			if lastMessage != notifier.U2F_OFF {
-				notifiers.Range(func(_, v interface{}) bool {
-					v.(chan notifier.Message) <- notifier.U2F_OFF
-					return true
-				})
+				broadcast(notifiers, notifier.Event{Message: notifier.U2F_OFF, Operation: lastOperation})
+				lastMessage = notifier.U2F_OFF
 			}
 			return
 		}
 
-		val1b := payload[7]
-		val2b := (int(payload[7]) << 8) | int(payload[8])
-		isU2F := payload[4] == CTAPHID_MSG && val2b == U2F_SW_CONDITIONS_NOT_SATISFIED
-		isFIDO2 := payload[4] == CTAPHID_KEEPALIVE && val1b == STATUS_UPNEEDED
+		frame, err := framer.push(payload[:n])
+		if err != nil {
+			log.Debugf("Dropping CTAPHID packet from '%v': %v", devicePath, err)
+			continue
+		}
+		if frame == nil {
+			// Wait for the remaining continuation packets
+			continue
+		}
+
+		mutex.Lock()
+		state := u2fState(frame, builtInUV, lastMessage == notifier.U2F_ON)
+		if state == notifier.STATE_UNKNOWN && frame.command == CTAPHID_KEEPALIVE && len(frame.data) > 0 && frame.data[0] != STATUS_PROCESSING {
+			log.Debugf("Unknown keepalive status %#x from '%v'", frame.data[0], devicePath)
+		}
+
+		if operation := u2fOperation(frame); operation != notifier.OPERATION_UNKNOWN && lastMessage == notifier.U2F_ON {
+			if operation == notifier.OPERATION_REGISTER {
+				log.Infof("A new FIDO credential was registered on '%v'", devicePath)
+			}
+			lastOperation = operation
+		}
 
 		// Cancel previous U2F_OFF timer
 		if u2fOffTimer != nil {
@@ -167,15 +267,29 @@ func runU2FWatcher(devicePath string, notifiers *sync.Map) {
 		// Wait just a tiny little bit more to see if no new U2F_ON messages arrive.
 		u2fOffTimerDuration := 200 * time.Millisecond
 
-		if isU2F || isFIDO2 {
-			// Signify U2F_ON if this is the first time we receive it
+		if state != notifier.STATE_UNKNOWN {
+			// Signify U2F_ON if this is the first time we receive it, and any change of state afterwards
 			if lastMessage != notifier.U2F_ON {
-				notifiers.Range(func(_, v interface{}) bool {
-					v.(chan notifier.Message) <- notifier.U2F_ON
-					return true
-				})
+				broadcast(notifiers, notifier.Event{Message: notifier.U2F_ON, State: state})
 				lastMessage = notifier.U2F_ON
+				lastOperation = notifier.OPERATION_UNKNOWN
+				process = nil
+				waits++
+
+				// Looking through /proc takes a while on a busy system, the device is read meanwhile
+				go func(wait int) {
+					found := findProcess(devicePath)
+					mutex.Lock()
+					defer mutex.Unlock()
+					if found != nil && wait == waits && lastMessage == notifier.U2F_ON {
+						process = found
+						broadcast(notifiers, notifier.Event{Message: notifier.U2F_ON, Process: process, State: lastState, Update: true})
+					}
+				}(waits)
+			} else if state != lastState {
+				broadcast(notifiers, notifier.Event{Message: notifier.U2F_ON, Process: process, State: state, Update: true})
 			}
+			lastState = state
 
 			// Extend U2F_OFF timer duration because the last message was U2F_ON
 			u2fOffTimerDuration = 2 * time.Second
@@ -183,13 +297,88 @@ func runU2FWatcher(devicePath string, notifiers *sync.Map) {
 
 		// Signify U2F_OFF if no new messages arrive soon
 		u2fOffTimer = time.AfterFunc(u2fOffTimerDuration, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
 			if lastMessage != notifier.U2F_OFF {
-				notifiers.Range(func(_, v interface{}) bool {
-					v.(chan notifier.Message) <- notifier.U2F_OFF
-					return true
-				})
+				broadcast(notifiers, notifier.Event{Message: notifier.U2F_OFF, Operation: lastOperation})
 				lastMessage = notifier.U2F_OFF
 			}
 		})
+		mutex.Unlock()
+	}
+}
+
+// u2fState tells what the authenticator is waiting for, if a frame tells it is waiting at all
+func u2fState(frame *ctaphidFrame, builtInUV bool, waiting bool) notifier.State {
+	if frame.command == CTAPHID_MSG && frame.statusWord() == U2F_SW_CONDITIONS_NOT_SATISFIED {
+		return notifier.STATE_TOUCH
+	}
+	if frame.command != CTAPHID_KEEPALIVE || len(frame.data) == 0 {
+		return notifier.STATE_UNKNOWN
+	}
+
+	switch frame.data[0] {
+	case STATUS_UPNEEDED:
+		// Authenticators with a built-in sensor ask for the user presence and the fingerprint at once
+		if builtInUV {
+			return notifier.STATE_UV
+		}
+		return notifier.STATE_TOUCH
+	case STATUS_PROCESSING:
+		// The authenticator got what it needed from the user and is computing the response,
+		// this is only interesting in the middle of a wait
+		if waiting {
+			return notifier.STATE_PROCESSING
+		}
+	}
+	return notifier.STATE_UNKNOWN
+}
+
+// hasBuiltInUV tells whether the authenticator verifies the user with a fingerprint sensor, like YubiKey Bio does
+func hasBuiltInUV(device notifier.Device) bool {
+	return strings.Contains(strings.ToLower(device.Name), " bio")
+}
+
+// u2fOperation tells a registration from an authentication by the shape of a successful response
+func u2fOperation(frame *ctaphidFrame) notifier.Operation {
+	data := frame.data
+	switch frame.command {
+	case CTAPHID_CBOR:
+		if len(data) < 2 || data[0] != CTAP2_OK {
+			return notifier.OPERATION_UNKNOWN
+		}
+		shape, err := cborMapShape(data[1:])
+		if err != nil {
+			log.Debugf("Cannot decode CTAP2 response: %v", err)
+			return notifier.OPERATION_UNKNOWN
+		}
+		has := func(key uint64, major byte) bool {
+			value, ok := shape[key]
+			return ok && value == major
+		}
+
+		// makeCredential responds with {fmt, authData, attStmt},
+		// getAssertion with {credential (optional), authData, signature, ...}
+		if has(CTAP2_MAKE_CREDENTIAL_FMT, CBOR_MAJOR_TEXT) || has(CTAP2_MAKE_CREDENTIAL_ATT_STMT, CBOR_MAJOR_MAP) {
+			return notifier.OPERATION_REGISTER
+		}
+		if has(CTAP2_GET_ASSERTION_CREDENTIAL, CBOR_MAJOR_MAP) ||
+			(has(CTAP2_GET_ASSERTION_AUTH_DATA, CBOR_MAJOR_BYTES) && has(CTAP2_GET_ASSERTION_SIGNATURE, CBOR_MAJOR_BYTES)) {
+			return notifier.OPERATION_AUTHENTICATE
+		}
+	case CTAPHID_MSG:
+		if len(data) < 3 || frame.statusWord() != U2F_SW_NO_ERROR {
+			return notifier.OPERATION_UNKNOWN
+		}
+
+		// Register responds with the reserved byte 0x05 followed by the public key,
+		// authenticate with the user presence flags followed by the counter
+		if data[0] == U2F_REGISTER_ID {
+			return notifier.OPERATION_REGISTER
+		}
+		if data[0]&U2F_AUTH_FLAG_TUP != 0 {
+			return notifier.OPERATION_AUTHENTICATE
+		}
 	}
+	return notifier.OPERATION_UNKNOWN
 }
@@ -0,0 +1,323 @@
+package detector
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
+)
+
+const (
+	channelA = 0x11223344
+	channelB = 0x55667788
+)
+
+// watchVirtualAuthenticator runs WatchU2F restricted to the given virtual authenticator, and returns the events it emits.
+// The watcher is stopped when the test ends.
+func watchVirtualAuthenticator(t *testing.T, authenticator *virtualAuthenticator) chan notifier.Event {
+	events := make(chan notifier.Event, 10)
+	notifiers := &sync.Map{}
+	notifiers.Store("test", events)
+	exits := &sync.Map{}
+
+	go WatchU2F(notifiers, DeviceFilter{Include: []DeviceRule{{Serial: authenticator.uniq}}}, exits)
+	authenticator.waitUntilWatched()
+	t.Cleanup(func() {
+		if exit, ok := exits.Load("detector/u2f"); ok {
+			exit.(chan bool) <- true
+			<-exit.(chan bool)
+		}
+	})
+
+	if event := <-events; event.Message != notifier.DEVICE_ON || event.Device == nil || event.Device.Serial != authenticator.uniq {
+		t.Fatalf("Expected the virtual authenticator to arrive, got %v", event)
+	}
+	return events
+}
+
+// watchPipe runs the U2F watcher on reports written to the returned pipe, which are read like a hidraw device would be
+func watchPipe(t *testing.T, name string, findProcess func(string) *notifier.Process) (*io.PipeWriter, chan notifier.Event) {
+	events := make(chan notifier.Event, 10)
+	notifiers := &sync.Map{}
+	notifiers.Store("test", events)
+
+	reader, writer := io.Pipe()
+	done := make(chan bool)
+	go func() {
+		watchU2FReports(notifier.Device{Path: "/dev/hidraw-test", Name: name}, reader, CTAPHID_DEFAULT_REPORT, notifiers, findProcess)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		writer.Close()
+		<-done
+	})
+	return writer, events
+}
+
+func sendToPipe(t *testing.T, writer io.Writer, channel uint32, command byte, data []byte) {
+	t.Helper()
+	for _, report := range ctaphidReports(channel, command, data) {
+		if _, err := writer.Write(report); err != nil {
+			t.Fatalf("Cannot send input report: %v", err)
+		}
+	}
+}
+
+func noProcess(string) *notifier.Process {
+	return nil
+}
+
+// expectEvents waits for the given events, in order
+func expectEvents(t *testing.T, events chan notifier.Event, expected ...notifier.Event) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			if got.Message != want.Message || got.Operation != want.Operation || got.State != want.State || got.Update != want.Update {
+				t.Fatalf("Expected event %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected event %v, got nothing", want)
+		}
+	}
+}
+
+// expectNoMoreEvents makes sure nothing else is reported once the U2F_OFF timer had its chance to fire
+func expectNoMoreEvents(t *testing.T, events chan notifier.Event) {
+	t.Helper()
+	select {
+	case got := <-events:
+		t.Fatalf("Expected no more events, got %v", got)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestU2FState(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     ctaphidFrame
+		builtInUV bool
+		waiting   bool
+		state     notifier.State
+	}{
+		{"U2F conditions not satisfied", ctaphidFrame{command: CTAPHID_MSG, data: u2fConditionsNotMet}, false, false, notifier.STATE_TOUCH},
+		{"U2F response", ctaphidFrame{command: CTAPHID_MSG, data: u2fAuthenticateResponse}, false, true, notifier.STATE_UNKNOWN},
+		{"keepalive up needed", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: keepaliveUpNeeded}, false, false, notifier.STATE_TOUCH},
+		{"keepalive up needed with built-in UV", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: keepaliveUpNeeded}, true, false, notifier.STATE_UV},
+		{"keepalive processing during a wait", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: keepaliveProcessing}, false, true, notifier.STATE_PROCESSING},
+		{"keepalive processing without a wait", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: keepaliveProcessing}, false, false, notifier.STATE_UNKNOWN},
+		{"keepalive with unknown status", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: []byte{0x7e}}, false, true, notifier.STATE_UNKNOWN},
+		{"empty keepalive", ctaphidFrame{command: CTAPHID_KEEPALIVE}, false, false, notifier.STATE_UNKNOWN},
+		{"CTAP2 response", ctaphidFrame{command: CTAPHID_CBOR, data: getAssertionResponse}, false, true, notifier.STATE_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if state := u2fState(&test.frame, test.builtInUV, test.waiting); state != test.state {
+				t.Errorf("Expected state %q, got %q", test.state, state)
+			}
+		})
+	}
+}
+
+func TestU2FOperation(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     ctaphidFrame
+		operation notifier.Operation
+	}{
+		{"CTAP2 makeCredential", ctaphidFrame{command: CTAPHID_CBOR, data: makeCredentialResponse}, notifier.OPERATION_REGISTER},
+		{"CTAP2 getAssertion", ctaphidFrame{command: CTAPHID_CBOR, data: getAssertionResponse}, notifier.OPERATION_AUTHENTICATE},
+		{"CTAP2 error", ctaphidFrame{command: CTAPHID_CBOR, data: []byte{0x27}}, notifier.OPERATION_UNKNOWN},
+		{"CTAP2 truncated response", ctaphidFrame{command: CTAPHID_CBOR, data: getAssertionResponse[:20]}, notifier.OPERATION_UNKNOWN},
+		{"U2F register", ctaphidFrame{command: CTAPHID_MSG, data: u2fRegisterResponse}, notifier.OPERATION_REGISTER},
+		{"U2F authenticate", ctaphidFrame{command: CTAPHID_MSG, data: u2fAuthenticateResponse}, notifier.OPERATION_AUTHENTICATE},
+		{"U2F conditions not satisfied", ctaphidFrame{command: CTAPHID_MSG, data: u2fConditionsNotMet}, notifier.OPERATION_UNKNOWN},
+		{"keepalive", ctaphidFrame{command: CTAPHID_KEEPALIVE, data: keepaliveUpNeeded}, notifier.OPERATION_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if operation := u2fOperation(&test.frame); operation != test.operation {
+				t.Errorf("Expected operation %q, got %q", test.operation, operation)
+			}
+		})
+	}
+}
+
+func TestWatchU2FReportsAuthentication(t *testing.T) {
+	writer, events := watchPipe(t, "Yubico YubiKey OTP+FIDO+CCID", noProcess)
+
+	for i := 0; i < 3; i++ {
+		sendToPipe(t, writer, channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	}
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	sendToPipe(t, writer, channelA, CTAPHID_KEEPALIVE, keepaliveProcessing)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_PROCESSING, Update: true})
+
+	sendToPipe(t, writer, channelA, CTAPHID_CBOR, getAssertionResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
+
+func TestWatchU2FReportsProcessFoundLater(t *testing.T) {
+	found := make(chan bool)
+	firefox := &notifier.Process{PID: 42, Executable: "/usr/lib/firefox/firefox"}
+	writer, events := watchPipe(t, "Yubico YubiKey OTP+FIDO+CCID", func(string) *notifier.Process {
+		<-found
+		return firefox
+	})
+
+	// The wait is announced before the process is found, and reading the device goes on meanwhile
+	sendToPipe(t, writer, channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+	sendToPipe(t, writer, channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+
+	close(found)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH, Update: true})
+
+	sendToPipe(t, writer, channelA, CTAPHID_CBOR, getAssertionResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
+
+func TestWatchU2FReportsDeviceGone(t *testing.T) {
+	writer, events := watchPipe(t, "Yubico YubiKey OTP+FIDO+CCID", noProcess)
+
+	sendToPipe(t, writer, channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+	writer.Close()
+
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherFIDO2Authentication(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	for i := 0; i < 3; i++ {
+		authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	}
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	authenticator.send(channelA, CTAPHID_CBOR, getAssertionResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherFIDO2RegistrationWithProcessing(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveProcessing)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_PROCESSING, Update: true})
+
+	authenticator.send(channelA, CTAPHID_CBOR, makeCredentialResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_REGISTER})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherBuiltInUV(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey Bio FIDO Edition")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_UV})
+
+	authenticator.send(channelA, CTAPHID_CBOR, getAssertionResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherLegacyRegistrationAndAuthentication(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	for _, step := range []struct {
+		response  []byte
+		operation notifier.Operation
+	}{
+		{u2fRegisterResponse, notifier.OPERATION_REGISTER},
+		{u2fAuthenticateResponse, notifier.OPERATION_AUTHENTICATE},
+	} {
+		for i := 0; i < 3; i++ {
+			authenticator.send(channelA, CTAPHID_MSG, u2fConditionsNotMet)
+		}
+		expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+		authenticator.send(channelA, CTAPHID_MSG, step.response)
+		expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: step.operation})
+	}
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherError(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	// CTAPHID_ERROR with ERR_INVALID_CHANNEL, e.g. when the client cancelled the request
+	authenticator.send(channelA, TYPE_INIT|0x3f, []byte{0x0b})
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherInterleavedChannels(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	// Continuation packets of one channel must not be confused with packets of another channel
+	reports := ctaphidReports(channelA, CTAPHID_CBOR, makeCredentialResponse)
+	authenticator.sendReport(reports[0])
+	authenticator.send(channelB, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	for _, report := range reports[1:] {
+		authenticator.sendReport(report)
+		authenticator.send(channelB, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	}
+	authenticator.send(channelB, CTAPHID_CBOR, getAssertionResponse)
+
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherDeviceLeft(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	authenticator.destroy()
+	expectEvents(t, events,
+		notifier.Event{Message: notifier.U2F_OFF},
+		notifier.Event{Message: notifier.DEVICE_OFF},
+	)
+	expectNoMoreEvents(t, events)
+}
+
+func TestU2FWatcherRediscoveredDevice(t *testing.T) {
+	authenticator := newVirtualAuthenticator(t, "Yubico YubiKey OTP+FIDO+CCID")
+	events := watchVirtualAuthenticator(t, authenticator)
+
+	// A spurious create event for a device that is already watched must not start a second reader
+	startU2FWatcher(authenticator.hidrawPath, DeviceFilter{}, nil, nil)
+
+	authenticator.send(channelA, CTAPHID_KEEPALIVE, keepaliveUpNeeded)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_ON, State: notifier.STATE_TOUCH})
+
+	authenticator.send(channelA, CTAPHID_CBOR, getAssertionResponse)
+	expectEvents(t, events, notifier.Event{Message: notifier.U2F_OFF, Operation: notifier.OPERATION_AUTHENTICATE})
+	expectNoMoreEvents(t, events)
+}
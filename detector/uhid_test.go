@@ -0,0 +1,203 @@
+package detector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// https://github.com/torvalds/linux/blob/master/include/uapi/linux/uhid.h
+	UHID_DESTROY = 1
+	UHID_CREATE2 = 11
+	UHID_INPUT2  = 12
+
+	UHID_DATA_MAX   = 4096
+	UHID_EVENT_SIZE = 4 + 128 + 64 + 64 + 2 + 2 + 4 + 4 + 4 + 4 + UHID_DATA_MAX
+	BUS_USB         = 0x03
+)
+
+// fidoReportDescriptor is the CTAPHID interface descriptor of a YubiKey 5
+var fidoReportDescriptor = []byte{
+	0x06, 0xd0, 0xf1, // Usage Page (FIDO Alliance)
+	0x09, 0x01, // Usage (CTAPHID)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x20, //   Usage (Input Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x40, //   Report Count (64)
+	0x81, 0x02, //   Input (Data, Var, Abs)
+	0x09, 0x21, //   Usage (Output Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x40, //   Report Count (64)
+	0x91, 0x02, //   Output (Data, Var, Abs)
+	0xc0, // End Collection
+}
+
+// virtualAuthenticator is a FIDO HID device created through /dev/uhid, whose input reports are scripted by the test
+type virtualAuthenticator struct {
+	t          *testing.T
+	uhid       *os.File
+	uniq       string
+	hidrawPath string
+}
+
+func newVirtualAuthenticator(t *testing.T, name string) *virtualAuthenticator {
+	uhid, err := os.OpenFile("/dev/uhid", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("Cannot open /dev/uhid to create a virtual authenticator: %v", err)
+	}
+
+	a := &virtualAuthenticator{t: t, uhid: uhid, uniq: fmt.Sprintf("ytd-test-%d", time.Now().UnixNano())}
+	t.Cleanup(a.destroy)
+
+	event := make([]byte, UHID_EVENT_SIZE)
+	binary.NativeEndian.PutUint32(event[0:], UHID_CREATE2)
+	req := event[4:]
+	copy(req[0:128], name)
+	copy(req[128:192], "yubikey-touch-detector/test")
+	copy(req[192:256], a.uniq)
+	binary.NativeEndian.PutUint16(req[256:], uint16(len(fidoReportDescriptor)))
+	binary.NativeEndian.PutUint16(req[258:], BUS_USB)
+	binary.NativeEndian.PutUint32(req[260:], 0x1050)
+	binary.NativeEndian.PutUint32(req[264:], 0x0407)
+	copy(req[276:], fidoReportDescriptor)
+	if _, err := uhid.Write(event); err != nil {
+		t.Fatalf("Cannot create a virtual authenticator: %v", err)
+	}
+
+	// The kernel creates the hidraw node asynchronously
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if a.hidrawPath = a.findHidraw(); a.hidrawPath != "" {
+			if _, err := os.Stat(a.hidrawPath); err == nil {
+				return a
+			}
+		}
+	}
+	t.Fatalf("Virtual authenticator '%v' did not show up as a hidraw device", a.uniq)
+	return nil
+}
+
+func (a *virtualAuthenticator) findHidraw() string {
+	uevents, _ := filepath.Glob("/sys/class/hidraw/hidraw*/device/uevent")
+	for _, uevent := range uevents {
+		if info, err := os.ReadFile(uevent); err == nil && strings.Contains(string(info), "HID_UNIQ="+a.uniq+"\n") {
+			return path.Join("/dev", path.Base(path.Dir(path.Dir(uevent))))
+		}
+	}
+	return ""
+}
+
+func (a *virtualAuthenticator) destroy() {
+	if a.uhid == nil {
+		return
+	}
+	defer func() { a.uhid = nil }()
+
+	event := make([]byte, UHID_EVENT_SIZE)
+	binary.NativeEndian.PutUint32(event[0:], UHID_DESTROY)
+	if _, err := a.uhid.Write(event); err != nil {
+		a.t.Logf("Cannot destroy virtual authenticator: %v", err)
+	}
+	a.uhid.Close()
+}
+
+// waitUntilWatched blocks until this process keeps the hidraw node open, i.e. until the U2F watcher is reading it.
+// The node is also briefly opened to read its descriptor, so it has to be seen open twice in a row.
+func (a *virtualAuthenticator) waitUntilWatched() {
+	isOpen := func() bool {
+		fds, _ := os.ReadDir("/proc/self/fd")
+		for _, fd := range fds {
+			if target, err := os.Readlink(path.Join("/proc/self/fd", fd.Name())); err == nil && target == a.hidrawPath {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := 0
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if !isOpen() {
+			seen = 0
+		} else if seen++; seen == 2 {
+			return
+		}
+	}
+	a.t.Fatalf("Nobody started watching '%v'", a.hidrawPath)
+}
+
+// send splits a CTAPHID message into an initialization packet and continuation packets
+func (a *virtualAuthenticator) send(channel uint32, command byte, data []byte) {
+	for _, report := range ctaphidReports(channel, command, data) {
+		a.sendReport(report)
+	}
+}
+
+func (a *virtualAuthenticator) sendReport(report []byte) {
+	event := make([]byte, UHID_EVENT_SIZE)
+	binary.NativeEndian.PutUint32(event[0:], UHID_INPUT2)
+	binary.NativeEndian.PutUint16(event[4:], uint16(len(report)))
+	copy(event[6:], report)
+	if _, err := a.uhid.Write(event); err != nil {
+		a.t.Fatalf("Cannot send input report: %v", err)
+	}
+}
+
+func ctaphidReports(channel uint32, command byte, data []byte) [][]byte {
+	var reports [][]byte
+
+	report := make([]byte, CTAPHID_DEFAULT_REPORT)
+	binary.BigEndian.PutUint32(report[0:], channel)
+	report[4] = command
+	binary.BigEndian.PutUint16(report[5:], uint16(len(data)))
+	n := copy(report[CTAPHID_INIT_HEADER_SIZE:], data)
+	reports = append(reports, report)
+
+	for seq := byte(0); n < len(data); seq++ {
+		report := make([]byte, CTAPHID_DEFAULT_REPORT)
+		binary.BigEndian.PutUint32(report[0:], channel)
+		report[4] = seq
+		n += copy(report[CTAPHID_CONT_HEADER_SIZE:], data[n:])
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Scripted responses, only their shape matters to the detector
+var (
+	keepaliveUpNeeded   = []byte{STATUS_UPNEEDED}
+	keepaliveProcessing = []byte{STATUS_PROCESSING}
+	u2fConditionsNotMet = []byte{0x69, 0x85}
+
+	// {1: "packed", 2: authData, 3: {}}
+	makeCredentialResponse = cborResponse([]byte{0xa3, 0x01, 0x66, 'p', 'a', 'c', 'k', 'e', 'd', 0x02, 0x58, 0x80}, 128, []byte{0x03, 0xa0})
+	// {1: {}, 2: authData, 3: signature}
+	getAssertionResponse = cborResponse([]byte{0xa3, 0x01, 0xa0, 0x02, 0x58, 0x25}, 37, []byte{0x03, 0x58, 0x48}, 72)
+	// 0x05 | public key | key handle | certificate | signature | 0x9000
+	u2fRegisterResponse = append(append([]byte{U2F_REGISTER_ID}, bytes.Repeat([]byte{0x04}, 200)...), 0x90, 0x00)
+	// user presence | counter | signature | 0x9000
+	u2fAuthenticateResponse = append(append([]byte{U2F_AUTH_FLAG_TUP, 0, 0, 0, 1}, bytes.Repeat([]byte{0x30}, 70)...), 0x90, 0x00)
+)
+
+// cborResponse builds a successful CTAP2 response out of encoded pieces and the lengths of zero-filled byte strings
+func cborResponse(pieces ...interface{}) []byte {
+	response := []byte{CTAP2_OK}
+	for _, piece := range pieces {
+		switch p := piece.(type) {
+		case []byte:
+			response = append(response, p...)
+		case int:
+			response = append(response, make([]byte, p)...)
+		}
+	}
+	return response
+}
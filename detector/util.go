@@ -1,8 +1,14 @@
 package detector
 
 import (
+	"os"
+	"sync"
+	"time"
+
 	"github.com/rjeczalik/notify"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/maximbaz/yubikey-touch-detector/notifier"
 )
 
 func initInotifyWatcher(detector string, path string, eventTypes ...notify.Event) chan notify.EventInfo {
@@ -14,3 +20,24 @@ func initInotifyWatcher(detector string, path string, eventTypes ...notify.Event
 	log.Debugf("%v watcher on '%v' is successfully established", detector, path)
 	return events
 }
+
+// waitForDir blocks until a directory exists
+func waitForDir(dir string) {
+	if _, err := os.Stat(dir); err == nil {
+		return
+	}
+	log.Debugf("Directory '%v' does not exist or cannot stat it, waiting for it to appear", dir)
+	for {
+		time.Sleep(5 * time.Second)
+		if _, err := os.Stat(dir); err == nil {
+			return
+		}
+	}
+}
+
+func broadcast(notifiers *sync.Map, event notifier.Event) {
+	notifiers.Range(func(_, v interface{}) bool {
+		v.(chan notifier.Event) <- event
+		return true
+	})
+}
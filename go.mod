@@ -10,9 +10,5 @@ require (
 	github.com/rjeczalik/notify v0.9.3
 	github.com/sirupsen/logrus v1.9.3
 	github.com/vtolstov/go-ioctl v0.0.0-20151206205506-6be9cced4810
-)
-
-require (
-	github.com/deckarep/golang-set v1.8.0
-	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/sys v0.27.0
 )
@@ -6,10 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"path"
-	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/proglottis/gpgme"
 	log "github.com/sirupsen/logrus"
@@ -29,6 +30,14 @@ func main() {
 	envStdout := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_STDOUT"))]
 	envNosocket := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_NOSOCKET"))]
 	envDbus := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_DBUS"))]
+	envGPGProxy := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_PROXY"))]
+	envGPGRemote := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_REMOTE"))]
+	envGPGHomes := os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_HOMES")
+	envGPGFanotify := truthyValues[strings.ToLower(os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_FANOTIFY"))]
+	envGPGIgnoreProcesses := os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_IGNORE_PROCESSES")
+	envGPGProbe := os.Getenv("YUBIKEY_TOUCH_DETECTOR_GPG_PROBE")
+	envIncludeDevices := os.Getenv("YUBIKEY_TOUCH_DETECTOR_INCLUDE_DEVICES")
+	envExcludeDevices := os.Getenv("YUBIKEY_TOUCH_DETECTOR_EXCLUDE_DEVICES")
 
 	var version bool
 	var verbose bool
@@ -36,6 +45,14 @@ func main() {
 	var stdout bool
 	var nosocket bool
 	var dbus bool
+	var gpgProxy bool
+	var gpgRemote bool
+	var gpgHomes string
+	var gpgFanotify bool
+	var gpgIgnoreProcesses string
+	var gpgProbe string
+	var includeDevices string
+	var excludeDevices string
 
 	flag.BoolVar(&version, "version", false, "print version and exit")
 	flag.BoolVar(&verbose, "v", envVerbose, "enable debug logging")
@@ -43,6 +60,23 @@ func main() {
 	flag.BoolVar(&stdout, "stdout", envStdout, "print notifications to stdout")
 	flag.BoolVar(&nosocket, "no-socket", envNosocket, "disable unix socket notifier")
 	flag.BoolVar(&dbus, "dbus", envDbus, "enable dbus server for IPC")
+	flag.BoolVar(&gpgProxy, "gpg-proxy", envGPGProxy, "detect GPG operations by proxying the gpg-agent socket instead of probing the card")
+	flag.BoolVar(&gpgRemote, "gpg-remote", envGPGRemote, "detect GPG operations on a gpg-agent socket forwarded from another host")
+	flag.StringVar(&gpgHomes, "gpg-homes", envGPGHomes, "watch the agents of these GnuPG home directories instead of the default one, e.g. '~/.gnupg,~/.gnupg-work'")
+	flag.BoolVar(&gpgFanotify, "gpg-fanotify", envGPGFanotify, "detect opened GPG key files with fanotify, which tells who opened them (requires CAP_SYS_ADMIN)")
+	flag.StringVar(&gpgIgnoreProcesses, "gpg-ignore-processes", envGPGIgnoreProcesses, "with -gpg-fanotify, ignore GPG key files opened by these processes, e.g. 'updatedb,restic'")
+	flag.StringVar(&gpgProbe, "gpg-probe", orDefault(envGPGProbe, "serialno"), "how to check whether the card is busy: learn or serialno")
+	flag.StringVar(&includeDevices, "include-devices", envIncludeDevices, "only watch U2F and HMAC devices matching these rules, e.g. 'id=1050:*,name=*nitrokey*'")
+	flag.StringVar(&excludeDevices, "exclude-devices", envExcludeDevices, "never watch U2F and HMAC devices matching these rules, e.g. 'path=/dev/hidraw3,id=20a0:42b1&serial=1234'")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [options] [command]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  devices\tlist connected security keys, as seen by the running detector if any")
+		fmt.Fprintln(flag.CommandLine.Output(), "  record [FILE]\trecord raw traffic of FIDO devices into FILE (or stdout) until interrupted")
+		fmt.Fprintln(flag.CommandLine.Output(), "  replay FILE\tfeed a recorded FILE through the U2F detector and print the events")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nOptions:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if version {
@@ -57,6 +91,35 @@ func main() {
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 	log.Debug("Starting YubiKey touch detector")
 
+	var deviceFilter detector.DeviceFilter
+	var err error
+	if deviceFilter.Include, err = detector.ParseDeviceRules(includeDevices); err != nil {
+		log.Fatalf("Cannot parse -include-devices: %v", err)
+	}
+	if deviceFilter.Exclude, err = detector.ParseDeviceRules(excludeDevices); err != nil {
+		log.Fatalf("Cannot parse -exclude-devices: %v", err)
+	}
+
+	probe, err := detector.FindCardProbe(gpgProbe)
+	if err != nil {
+		log.Fatalf("Cannot parse -gpg-probe: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "devices":
+		listDevices(deviceFilter)
+		return
+	case "record":
+		recordU2F(flag.Arg(1), deviceFilter)
+		return
+	case "replay":
+		replayU2F(flag.Arg(1))
+		return
+	default:
+		log.Fatalf("Unknown command '%v'", flag.Arg(0))
+	}
+
 	exits := &sync.Map{}
 	go setupExitSignalWatch(exits)
 
@@ -78,68 +141,165 @@ func main() {
 		go notifier.SetupDbusNotifier(notifiers)
 	}
 
-	go detector.WatchU2F(notifiers)
-	go detector.WatchHMAC(notifiers)
-	initGPGBasedDetectors(notifiers, exits)
+	go detector.WatchU2F(notifiers, deviceFilter, exits)
+	go detector.WatchHMAC(notifiers, deviceFilter)
+	for _, home := range detector.ParseGPGHomes(expandHome(gpgHomes), gpgme.GetDirInfo("homedir")) {
+		if gpgRemote {
+			keyring := detector.NewGPGKeyring(home.Dir)
+			go detector.WatchForwardedGPGAgent(home, keyring, detector.NewGPGWaits(home, notifiers), exits)
+		} else {
+			go initGPGBasedDetectors(home, notifiers, exits, gpgProxy, gpgFanotify, splitList(gpgIgnoreProcesses), probe)
+		}
+	}
 
 	wait := make(chan bool)
 	<-wait
 }
 
-func initGPGBasedDetectors(notifiers, exits *sync.Map) {
-	ctx, err := gpgme.New()
+func initGPGBasedDetectors(home detector.GPGHome, notifiers, exits *sync.Map, gpgProxy bool, gpgFanotify bool, ignoredProcesses []string, probe detector.CardProbe) {
+	keys := detector.WatchShadowedKeys(path.Join(home.Dir, "private-keys-v1.d"))
+	keys.WaitForAny()
+	log.Debugf("Found shadowed private keys in '%v', starting its GPG and SSH watchers", home)
+
+	agent, err := detector.FollowGPGAgent(home, notifiers)
 	if err != nil {
-		log.Debugf("Cannot initialize GPG context: %v. Disabling GPG and SSH watchers.", err)
+		log.Debugf("Cannot initialize GPG context for '%v': %v. Disabling its GPG and SSH watchers.", home, err)
 		return
 	}
 
-	if ctx.SetProtocol(gpgme.ProtocolAssuan) != nil {
-		log.Debugf("Cannot initialize Assuan IPC: %v. Disabling GPG and SSH watchers.", err)
-		return
+	keyring := detector.NewGPGKeyring(home.Dir)
+	policies := detector.NewCardTouchPolicies()
+	// The probe and the proxies of a home may notice the same operation, they report it as a single wait
+	waits := detector.NewGPGWaits(home, notifiers)
+	requestGPGCheck := make(chan detector.GPGCheckRequest)
+	go detector.CheckGPGOnRequest(agent, probe, requestGPGCheck, waits, keyring, policies)
+	if gpgProxy {
+		go detector.WatchGPGAgent(home, keys, keyring, policies, waits, exits)
+	} else {
+		go detector.WatchGPG(keys, requestGPGCheck, gpgFanotify, ignoredProcesses)
 	}
+	go detector.WatchSSH(home, agent, keyring, policies, requestGPGCheck, waits, exits)
+}
 
-	var gpgPrivateKeysDirPath = path.Join(gpgme.GetDirInfo("homedir"), "private-keys-v1.d")
-	if _, err := os.Stat(gpgPrivateKeysDirPath); err != nil {
-		log.Debugf("Directory '%s' does not exist or cannot stat it\n", gpgPrivateKeysDirPath)
-		return
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
 	}
+	return value
+}
 
-	filesToWatch, err := findShadowedPrivateKeys(gpgPrivateKeysDirPath)
+// splitList reads a comma separated list, skipping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// expandHome replaces a leading ~ of each directory in a comma separated list, as a shell would
+func expandHome(dirs string) string {
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		log.Debugf("Error finding shadowed private keys: %v\n", err)
-		return
+		return dirs
+	}
+	expanded := strings.Split(dirs, ",")
+	for i, dir := range expanded {
+		dir = strings.TrimSpace(dir)
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			expanded[i] = homeDir + dir[1:]
+		}
 	}
+	return strings.Join(expanded, ",")
+}
 
-	if len(filesToWatch) == 0 {
-		log.Debugf("No shadowed private keys found.\n")
-		return
+func listDevices(deviceFilter detector.DeviceFilter) {
+	keys, err := notifier.QueryUnixSocketDevices()
+	if err != nil {
+		log.Debugf("Cannot query the running detector, looking for devices directly: %v", err)
+		if keys, err = detector.ListKeys(deviceFilter); err != nil {
+			log.Fatalf("Cannot list devices: %v", err)
+		}
 	}
 
-	requestGPGCheck := make(chan bool)
-	go detector.CheckGPGOnRequest(requestGPGCheck, notifiers, ctx)
-	go detector.WatchGPG(filesToWatch, requestGPGCheck)
-	go detector.WatchSSH(requestGPGCheck, exits)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tSERIAL\tFIRMWARE\tINTERFACES\tHIDRAW\tWATCHED")
+	for _, key := range keys {
+		watched := "no"
+		if key.Watched {
+			watched = "yes"
+		}
+		fmt.Fprintf(writer, "%v\t%04x:%04x\t%v\t%v\t%v\t%v\t%v\n", key.Name, key.VendorID, key.ProductID,
+			orDash(key.Serial), orDash(key.Firmware), orDash(strings.Join(key.Interfaces, ",")), orDash(strings.Join(key.HidrawPaths, ",")), watched)
+	}
+	writer.Flush()
 }
 
-func findShadowedPrivateKeys(folderPath string) ([]string, error) {
-	var result []string
-	err := filepath.WalkDir(folderPath, func(path string, info os.DirEntry, err error) error {
-		if err != nil || info.IsDir() {
-			return err
-		}
-		data, err := os.ReadFile(path)
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func recordU2F(outputPath string, deviceFilter detector.DeviceFilter) {
+	output := os.Stdout
+	if outputPath != "" && outputPath != "-" {
+		file, err := os.Create(outputPath)
 		if err != nil {
-			return err
+			log.Fatalf("Cannot create trace file: %v", err)
 		}
-		if strings.Contains(string(data), "shadowed-private-key") {
-			result = append(result, path)
-		}
-		return nil
-	})
+		output = file
+	}
+
+	go func() {
+		exitSignal := make(chan os.Signal, 1)
+		signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
+		<-exitSignal
+		output.Close()
+		os.Exit(0)
+	}()
+
+	log.Info("Recording FIDO devices, reproduce the problem and press Ctrl+C to stop")
+	if err := detector.RecordU2F(output, deviceFilter); err != nil {
+		log.Fatalf("Cannot record FIDO devices: %v", err)
+	}
+	output.Close()
+}
+
+func replayU2F(inputPath string) {
+	input, err := os.Open(inputPath)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Cannot open trace file: %v", err)
+	}
+	defer input.Close()
+
+	events := make(chan notifier.Event, 10)
+	notifiers := &sync.Map{}
+	notifiers.Store("replay", events)
+
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- detector.ReplayU2F(input, notifiers)
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			fmt.Printf("%8.3fs %v\n", time.Since(start).Seconds(), event)
+		case err := <-done:
+			if err != nil {
+				log.Fatalf("Cannot replay trace file: %v", err)
+			}
+			for len(events) > 0 {
+				fmt.Printf("%8.3fs %v\n", time.Since(start).Seconds(), <-events)
+			}
+			return
+		}
 	}
-	return result, nil
 }
 
 func setupExitSignalWatch(exits *sync.Map) {
@@ -1,6 +1,7 @@
 package notifier
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/godbus/dbus/v5"
@@ -15,6 +16,17 @@ const DBUS_PATH dbus.ObjectPath = "/com/github/maximbaz/YubikeyTouchDetector"
 const PROP_GPG_STATE string = "GPGState"
 const PROP_U2F_STATE string = "U2FState"
 const PROP_HMAC_STATE string = "HMACState"
+const PROP_U2F_WAIT_STATE string = "U2FWaitState"
+const PROP_GPG_WAIT_STATE string = "GPGWaitState"
+const PROP_DEVICES string = "Devices"
+const PROP_GPG_TOUCH_CACHED_UNTIL string = "GPGTouchCachedUntil"
+const PROP_GPG_HOME string = "GPGHome"
+const PROP_GPG_CARD_SERIAL string = "GPGCardSerial"
+const PROP_GPG_AGENTS_DOWN string = "GPGAgentsDown"
+const PROP_HMAC_DEVICE string = "HMACDevice"
+
+const SIGNAL_DEVICE_ADDED string = "DeviceAdded"
+const SIGNAL_DEVICE_REMOVED string = "DeviceRemoved"
 
 var messagePropMap = map[Message]string{
 	GPG_ON:   PROP_GPG_STATE,
@@ -75,6 +87,54 @@ func SetupDbusNotifier(notifiers *sync.Map) {
 					return nil
 				},
 			},
+			PROP_U2F_WAIT_STATE: {
+				Value:    string(STATE_UNKNOWN),
+				Writable: true,
+				Emit:     prop.EmitTrue,
+				Callback: func(c *prop.Change) *dbus.Error {
+					log.Debug(DBUS_IFACE, ".", c.Name, " changed to ", c.Value)
+					return nil
+				},
+			},
+			PROP_GPG_TOUCH_CACHED_UNTIL: {
+				Value:    int64(0),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
+			PROP_GPG_HOME: {
+				Value:    "",
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
+			PROP_GPG_CARD_SERIAL: {
+				Value:    "",
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
+			PROP_GPG_AGENTS_DOWN: {
+				Value:    []string{},
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
+			PROP_HMAC_DEVICE: {
+				Value:    map[string]dbus.Variant{},
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
+			PROP_GPG_WAIT_STATE: {
+				Value:    string(STATE_UNKNOWN),
+				Writable: true,
+				Emit:     prop.EmitTrue,
+				Callback: func(c *prop.Change) *dbus.Error {
+					log.Debug(DBUS_IFACE, ".", c.Name, " changed to ", c.Value)
+					return nil
+				},
+			},
+			PROP_DEVICES: {
+				Value:    []map[string]dbus.Variant{},
+				Writable: false,
+				Emit:     prop.EmitTrue,
+			},
 			PROP_HMAC_STATE: {
 				Value:    uint32(0),
 				Writable: true,
@@ -108,6 +168,10 @@ func SetupDbusNotifier(notifiers *sync.Map) {
 				Name:       DBUS_IFACE,
 				Methods:    introspect.Methods(s),
 				Properties: props.Introspection(DBUS_IFACE),
+				Signals: []introspect.Signal{
+					{Name: SIGNAL_DEVICE_ADDED, Args: []introspect.Arg{{Name: "device", Type: "a{sv}", Direction: "out"}}},
+					{Name: SIGNAL_DEVICE_REMOVED, Args: []introspect.Arg{{Name: "device", Type: "a{sv}", Direction: "out"}}},
+				},
 			},
 		},
 	}
@@ -118,14 +182,131 @@ func SetupDbusNotifier(notifiers *sync.Map) {
 	}
 	log.Debug("Connected to dbus session interface ", DBUS_IFACE)
 
-	touch := make(chan Message, 10)
+	touch := make(chan Event, 10)
 	notifiers.Store("notifier/dbus", touch)
 
+	devices := make(map[string]map[string]dbus.Variant)
+	agentsDown := make(map[string]bool)
+	// Several agents may wait for their cards at once
+	gpgWaits := newGPGWaits()
 	for {
-		message := <-touch
-		err := props.Set(DBUS_IFACE, messagePropMap[message], messageValueMap[message])
-		if err != nil {
-			log.Warn("dbus failed to update property ", messagePropMap[message], ", ", err)
+		event := <-touch
+		message := event.Message
+		gpgWaits.follow(event)
+
+		if property, ok := messagePropMap[message]; ok && !(message == GPG_OFF && len(gpgWaits.events) > 0) {
+			err := props.Set(DBUS_IFACE, property, messageValueMap[message])
+			if err != nil {
+				log.Warn("dbus failed to update property ", property, ", ", err)
+			}
+		}
+
+		if (message == DEVICE_ON || message == DEVICE_OFF) && event.Key != nil {
+			device := dbusKey(*event.Key)
+			signal := SIGNAL_DEVICE_ADDED
+			if message == DEVICE_ON {
+				devices[event.Key.ID] = device
+			} else {
+				delete(devices, event.Key.ID)
+				signal = SIGNAL_DEVICE_REMOVED
+			}
+
+			list := []map[string]dbus.Variant{}
+			for _, identity := range sortedKeys(devices) {
+				list = append(list, devices[identity])
+			}
+			props.SetMust(DBUS_IFACE, PROP_DEVICES, list)
+
+			if !event.Update {
+				if err := conn.Emit(DBUS_PATH, DBUS_IFACE+"."+signal, device); err != nil {
+					log.Warn("dbus failed to emit signal ", signal, ", ", err)
+				}
+			}
+		}
+
+		if message == GPG_ON || message == GPG_OFF {
+			// Describe the wait of the home that sent the event, or of another home that still waits
+			wait, waiting := gpgWaits.events[event.GPGHome]
+			if !waiting && len(gpgWaits.events) > 0 {
+				wait = gpgWaits.events[sortedKeys(gpgWaits.events)[0]]
+			}
+			if err := props.Set(DBUS_IFACE, PROP_GPG_WAIT_STATE, dbus.MakeVariant(string(wait.State))); err != nil {
+				log.Warn("dbus failed to update property ", PROP_GPG_WAIT_STATE, ", ", err)
+			}
+			props.SetMust(DBUS_IFACE, PROP_GPG_HOME, wait.GPGHome)
+			props.SetMust(DBUS_IFACE, PROP_GPG_CARD_SERIAL, wait.CardSerial)
+		}
+
+		if message == GPG_OFF {
+			cachedUntil := int64(0)
+			if !event.TouchCachedUntil.IsZero() {
+				cachedUntil = event.TouchCachedUntil.Unix()
+			}
+			props.SetMust(DBUS_IFACE, PROP_GPG_TOUCH_CACHED_UNTIL, cachedUntil)
+		}
+
+		if message == GPG_AGENT_UP || message == GPG_AGENT_DOWN {
+			if message == GPG_AGENT_DOWN {
+				agentsDown[event.GPGHome] = true
+			} else {
+				delete(agentsDown, event.GPGHome)
+			}
+			props.SetMust(DBUS_IFACE, PROP_GPG_AGENTS_DOWN, sortedKeys(agentsDown))
+		}
+
+		if message == HMAC_ON || message == HMAC_OFF {
+			device := map[string]dbus.Variant{}
+			if message == HMAC_ON && event.Device != nil {
+				device = dbusDevice(*event.Device)
+			}
+			props.SetMust(DBUS_IFACE, PROP_HMAC_DEVICE, device)
+		}
+
+		if message == U2F_ON || message == U2F_OFF {
+			state := event.State
+			if message == U2F_OFF {
+				state = STATE_UNKNOWN
+			}
+			if err := props.Set(DBUS_IFACE, PROP_U2F_WAIT_STATE, dbus.MakeVariant(string(state))); err != nil {
+				log.Warn("dbus failed to update property ", PROP_U2F_WAIT_STATE, ", ", err)
+			}
 		}
 	}
 }
+
+func dbusKey(key Key) map[string]dbus.Variant {
+	path := ""
+	if len(key.HidrawPaths) > 0 {
+		path = key.HidrawPaths[0]
+	}
+	return map[string]dbus.Variant{
+		"Name":       dbus.MakeVariant(key.Name),
+		"VendorID":   dbus.MakeVariant(key.VendorID),
+		"ProductID":  dbus.MakeVariant(key.ProductID),
+		"Serial":     dbus.MakeVariant(key.Serial),
+		"Firmware":   dbus.MakeVariant(key.Firmware),
+		"Interfaces": dbus.MakeVariant(append([]string{}, key.Interfaces...)),
+		"Hidraw":     dbus.MakeVariant(append([]string{}, key.HidrawPaths...)),
+		"Path":       dbus.MakeVariant(path),
+		"Watched":    dbus.MakeVariant(key.Watched),
+	}
+}
+
+func dbusDevice(device Device) map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"Name":      dbus.MakeVariant(device.Name),
+		"VendorID":  dbus.MakeVariant(device.VendorID),
+		"ProductID": dbus.MakeVariant(device.ProductID),
+		"Serial":    dbus.MakeVariant(device.Serial),
+		"Path":      dbus.MakeVariant(device.Path),
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
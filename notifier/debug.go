@@ -8,7 +8,7 @@ import (
 
 // SetupDebugNotifier configures a notifier to log all touch events
 func SetupDebugNotifier(notifiers *sync.Map) {
-	touch := make(chan Message, 10)
+	touch := make(chan Event, 10)
 	notifiers.Store("notifier/debug", touch)
 
 	for {
@@ -1,6 +1,7 @@
 package notifier
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 
@@ -11,7 +12,7 @@ import (
 
 // SetupLibnotifyNotifier configures a notifier to show all touch requests with libnotify
 func SetupLibnotifyNotifier(notifiers *sync.Map) {
-	touch := make(chan Message, 10)
+	touch := make(chan Event, 10)
 	notifiers.Store("notifier/libnotify", touch)
 
 	conn, err := dbus.SessionBusPrivate()
@@ -31,10 +32,11 @@ func SetupLibnotifyNotifier(notifiers *sync.Map) {
 		return
 	}
 
+	defaultSummary := libnotifySummary(nil, STATE_TOUCH)
 	notification := notify.Notification{
 		AppName: "yubikey-touch-detector",
 		AppIcon: "yubikey-touch-detector",
-		Summary: "YubiKey is waiting for a touch",
+		Summary: defaultSummary,
 	}
 
 	reset := func(msg *notify.NotificationClosedSignal) {
@@ -53,16 +55,51 @@ func SetupLibnotifyNotifier(notifiers *sync.Map) {
 	defer notifier.Close()
 
 	activeTouchWaits := 0
+	var process *Process
+	gpgWaits := newGPGWaits()
 
 	for {
-		value := <-touch
-		if value == GPG_ON || value == U2F_ON || value == HMAC_ON {
+		event := <-touch
+		value := event.Message
+		switch value {
+		case GPG_ON, GPG_OFF, U2F_ON, U2F_OFF, HMAC_ON, HMAC_OFF:
+		default:
+			// Keys coming and going, or the agent going down, must not overwrite the description of a wait
+			continue
+		}
+		if (value == GPG_ON || value == U2F_ON || value == HMAC_ON) && !event.Update {
 			activeTouchWaits++
+			process = event.Process
+		}
+		if value == U2F_ON && event.Update && event.Process != nil {
+			// The process is found after the wait was announced
+			process = event.Process
 		}
 		if value == GPG_OFF || value == U2F_OFF || value == HMAC_OFF {
 			activeTouchWaits--
 		}
-		if activeTouchWaits > 0 {
+		gpgWaits.follow(event)
+		waitsForPIN := false
+		for _, wait := range gpgWaits.events {
+			waitsForPIN = waitsForPIN || wait.State == STATE_PIN
+		}
+
+		// Describe the wait only while it is the one and only
+		notification.Summary = defaultSummary
+		notification.Body = ""
+		if activeTouchWaits == 1 && value == U2F_ON {
+			notification.Summary = libnotifySummary(process, event.State)
+		}
+		if activeTouchWaits == 1 && value == GPG_ON {
+			notification.Summary = libnotifyGPGSummary(event.Operation, event.GPGKey, event.CardSerial)
+		}
+		if activeTouchWaits == 1 && value == HMAC_ON && event.Device != nil {
+			// With several keys plugged in, tell which one to touch
+			notification.Body = event.Device.String()
+		}
+
+		// Nobody should be asked for a touch while typing the PIN
+		if activeTouchWaits > 0 && !(activeTouchWaits == 1 && waitsForPIN) {
 			id, err := notifier.SendNotification(notification)
 			if err != nil {
 				log.Error("Cannot show notification: ", err)
@@ -78,3 +115,36 @@ func SetupLibnotifyNotifier(notifiers *sync.Map) {
 		}
 	}
 }
+
+func libnotifySummary(process *Process, state State) string {
+	switch {
+	case state == STATE_PROCESSING:
+		return "YubiKey is processing the request"
+	case state == STATE_UV && process != nil:
+		return fmt.Sprintf("%v is waiting for your fingerprint", process.Name())
+	case state == STATE_UV:
+		return "YubiKey is waiting for your fingerprint"
+	case process != nil:
+		return fmt.Sprintf("%v is waiting for your YubiKey", process.Name())
+	}
+	return "YubiKey is waiting for a touch"
+}
+
+func libnotifyGPGSummary(operation Operation, key *GPGKey, card string) string {
+	// With several cards, the serial number tells which one to touch
+	onCard := ""
+	if card != "" {
+		onCard = fmt.Sprintf(" on card %v", card)
+	}
+	switch {
+	case operation != OPERATION_UNKNOWN && key != nil:
+		return fmt.Sprintf("Touch to %v with %v%v", operation, key, onCard)
+	case operation != OPERATION_UNKNOWN:
+		return fmt.Sprintf("Touch to %v%v", operation, onCard)
+	case key != nil:
+		return fmt.Sprintf("Touch to use %v%v", key, onCard)
+	case card != "":
+		return fmt.Sprintf("YubiKey %v is waiting for a touch", card)
+	}
+	return "YubiKey is waiting for a touch"
+}
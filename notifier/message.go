@@ -1,5 +1,13 @@
 package notifier
 
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
 type Message string
 
 // All messages have a fixed length of 5 chars to simplify code on the receiving side
@@ -10,4 +18,254 @@ const (
 	U2F_OFF  Message = "U2F_0"
 	HMAC_ON  Message = "MAC_1"
 	HMAC_OFF Message = "MAC_0"
+
+	DEVICE_ON  Message = "DEV_1"
+	DEVICE_OFF Message = "DEV_0"
+
+	GPG_AGENT_UP   Message = "AGT_1"
+	GPG_AGENT_DOWN Message = "AGT_0"
+)
+
+// Operation is the kind of operation a touch was requested for, if known
+type Operation string
+
+const (
+	OPERATION_UNKNOWN      Operation = ""
+	OPERATION_REGISTER     Operation = "register"
+	OPERATION_AUTHENTICATE Operation = "authenticate"
+	OPERATION_SIGN         Operation = "sign"
+	OPERATION_DECRYPT      Operation = "decrypt"
+)
+
+// State is what exactly an ongoing wait is waiting for
+type State string
+
+const (
+	STATE_UNKNOWN    State = ""
+	STATE_TOUCH      State = "touch"
+	STATE_UV         State = "uv"
+	STATE_PROCESSING State = "processing"
+	STATE_PIN        State = "pin"
 )
+
+// TouchPolicy is the touch policy of an OpenPGP card slot
+type TouchPolicy string
+
+const (
+	TOUCH_POLICY_UNKNOWN      TouchPolicy = ""
+	TOUCH_POLICY_OFF          TouchPolicy = "off"
+	TOUCH_POLICY_ON           TouchPolicy = "on"
+	TOUCH_POLICY_FIXED        TouchPolicy = "fixed"
+	TOUCH_POLICY_CACHED       TouchPolicy = "cached"
+	TOUCH_POLICY_CACHED_FIXED TouchPolicy = "cached-fixed"
+)
+
+// Device identifies a hidraw interface of a security key
+type Device struct {
+	Path      string
+	VendorID  uint16
+	ProductID uint16
+	Name      string
+	Serial    string
+
+	// Interface is the application behind the interface, one of INTERFACE_*
+	Interface string
+
+	// SysfsPath is the USB device the interface belongs to, shared by all interfaces of the same key
+	SysfsPath string
+}
+
+const (
+	INTERFACE_FIDO = "fido"
+	INTERFACE_OTP  = "otp"
+	INTERFACE_CCID = "ccid"
+)
+
+// Identity is the same for all interfaces of a key
+func (d Device) Identity() string {
+	if d.SysfsPath != "" {
+		return d.SysfsPath
+	}
+	return fmt.Sprintf("%04x:%04x:%v", d.VendorID, d.ProductID, d.Serial)
+}
+
+func (d Device) String() string {
+	description := fmt.Sprintf("%v [%04x:%04x]", d.Name, d.VendorID, d.ProductID)
+	if d.Serial != "" {
+		description += fmt.Sprintf(" #%v", d.Serial)
+	}
+	return description
+}
+
+// Key describes a connected security key as a whole, as listed in the device inventory
+type Key struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	VendorID    uint16   `json:"vendor_id"`
+	ProductID   uint16   `json:"product_id"`
+	Serial      string   `json:"serial,omitempty"`
+	Firmware    string   `json:"firmware,omitempty"`
+	Interfaces  []string `json:"interfaces"`
+	HidrawPaths []string `json:"hidraw"`
+
+	// Watched is set when the U2F detector is reading the FIDO interface of the key
+	Watched bool `json:"watched"`
+}
+
+// Equal tells whether two descriptions of a key are the same
+func (k Key) Equal(other Key) bool {
+	return k.ID == other.ID && k.Name == other.Name && k.VendorID == other.VendorID && k.ProductID == other.ProductID &&
+		k.Serial == other.Serial && k.Firmware == other.Firmware && k.Watched == other.Watched &&
+		slices.Equal(k.Interfaces, other.Interfaces) && slices.Equal(k.HidrawPaths, other.HidrawPaths)
+}
+
+// GPGKey identifies the OpenPGP key a touch was requested for
+type GPGKey struct {
+	Keygrip string
+	KeyID   string // long ID of the subkey
+	UserID  string // first user ID of the key
+}
+
+func (k GPGKey) String() string {
+	if k.UserID == "" {
+		return fmt.Sprintf("0x%v", k.KeyID)
+	}
+	return fmt.Sprintf("0x%v (%v)", k.KeyID, k.UserID)
+}
+
+// Process describes a process on whose behalf a touch was requested
+type Process struct {
+	PID         int
+	Executable  string
+	CommandLine []string
+}
+
+// Name returns a short human readable name of the process
+func (p Process) Name() string {
+	name := path.Base(p.Executable)
+	if pretty, ok := knownProcessNames[name]; ok {
+		return pretty
+	}
+	return name
+}
+
+var knownProcessNames = map[string]string{
+	"firefox":     "Firefox",
+	"firefox-bin": "Firefox",
+	"librewolf":   "LibreWolf",
+	"thunderbird": "Thunderbird",
+	"chrome":      "Chrome",
+	"chromium":    "Chromium",
+	"brave":       "Brave",
+	"msedge":      "Edge",
+	"vivaldi-bin": "Vivaldi",
+}
+
+// Event is a Message enriched with whatever a detector knows about it
+type Event struct {
+	Message Message
+
+	// Operation is set on U2F_OFF when the response that followed the touch could be decoded,
+	// and on GPG_ON when it is known what the key is used for
+	Operation Operation
+
+	// GPGHome is set on GPG_ON and GPG_OFF to the GnuPG home directory whose agent the operation went through,
+	// and on GPG_AGENT_UP and GPG_AGENT_DOWN to the home whose agent came back or went down
+	GPGHome string
+
+	// CardSerial is set on GPG_ON when the serial number of the OpenPGP card holding the key is known
+	CardSerial string
+
+	// GPGKey is set on GPG_ON when the key the touch was requested for is known
+	GPGKey *GPGKey
+
+	// TouchPolicy is set on GPG_ON when the touch policy of the card slot used for the operation is known
+	TouchPolicy TouchPolicy
+
+	// TouchCachedUntil is set on GPG_OFF when the card caches the touch that just happened, until that time
+	TouchCachedUntil time.Time
+
+	// Process is set on U2F_ON and GPG_ON when the process waiting for a touch could be found,
+	// U2F_ON tells it with an update once it is found
+	Process *Process
+
+	// State is set on U2F_ON and GPG_ON, and is updated with further such events while the wait is ongoing
+	State State
+
+	// Device is set when the event can be attributed to a specific key
+	Device *Device
+
+	// Key is set on DEVICE_ON and DEVICE_OFF, and is updated with further DEVICE_ON events when the key's interfaces change
+	Key *Key
+
+	// Update is set when the event only refines an ongoing wait that was already announced,
+	// e.g. when the authenticator got touched and is now processing the request
+	Update bool
+}
+
+func (e Event) String() string {
+	details := []string{}
+	if e.Operation != OPERATION_UNKNOWN {
+		details = append(details, fmt.Sprintf("operation=%v", e.Operation))
+	}
+	if e.State != STATE_UNKNOWN {
+		details = append(details, fmt.Sprintf("state=%v", e.State))
+	}
+	if e.Update {
+		details = append(details, "update")
+	}
+	if e.GPGHome != "" {
+		details = append(details, fmt.Sprintf("home=%v", e.GPGHome))
+	}
+	if e.CardSerial != "" {
+		details = append(details, fmt.Sprintf("card=%v", e.CardSerial))
+	}
+	if e.GPGKey != nil {
+		details = append(details, fmt.Sprintf("key=%v", e.GPGKey))
+	}
+	if e.TouchPolicy != TOUCH_POLICY_UNKNOWN {
+		details = append(details, fmt.Sprintf("touch-policy=%v", e.TouchPolicy))
+	}
+	if !e.TouchCachedUntil.IsZero() {
+		details = append(details, fmt.Sprintf("touch-cached-until=%v", e.TouchCachedUntil.Format(time.TimeOnly)))
+	}
+	if e.Device != nil {
+		details = append(details, fmt.Sprintf("device=%v", e.Device))
+	}
+	if e.Process != nil {
+		details = append(details, fmt.Sprintf("process=%v[%v]", e.Process.Name(), e.Process.PID))
+	}
+	if len(details) == 0 {
+		return string(e.Message)
+	}
+	return fmt.Sprintf("%v (%v)", e.Message, strings.Join(details, ", "))
+}
+
+// gpgWaits follows the ongoing GPG waits of each home, as notifiers see them.
+// A home may report several waits at once, e.g. when its proxies and its card probe notice different operations.
+type gpgWaits struct {
+	events map[string]Event
+	counts map[string]int
+}
+
+func newGPGWaits() *gpgWaits {
+	return &gpgWaits{events: make(map[string]Event), counts: make(map[string]int)}
+}
+
+// follow takes a GPG_ON or GPG_OFF event into account, a home is done waiting once all its waits are over
+func (w *gpgWaits) follow(event Event) {
+	home := event.GPGHome
+	switch {
+	case event.Message == GPG_ON && !event.Update:
+		w.counts[home]++
+		w.events[home] = event
+	case event.Message == GPG_ON && w.counts[home] > 0:
+		w.events[home] = event
+	case event.Message == GPG_OFF:
+		w.counts[home]--
+		if w.counts[home] <= 0 {
+			delete(w.counts, home)
+			delete(w.events, home)
+		}
+	}
+}
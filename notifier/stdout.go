@@ -7,11 +7,13 @@ import (
 
 // SetupStdoutNotifier configures a notifier to log to stdout
 func SetupStdoutNotifier(notifiers *sync.Map) {
-	touch := make(chan Message, 10)
+	touch := make(chan Event, 10)
 	notifiers.Store("notifier/stdout", touch)
 
 	for {
 		value := <-touch
-		fmt.Println(value)
+		if !value.Update {
+			fmt.Println(value.Message)
+		}
 	}
 }
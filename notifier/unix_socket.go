@@ -1,11 +1,15 @@
 package notifier
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/v22/activation"
 	log "github.com/sirupsen/logrus"
@@ -36,7 +40,7 @@ func SetupUnixSocketNotifier(notifiers *sync.Map, exits *sync.Map) {
 	} else if len(listeners) == 1 {
 		socket = listeners[0]
 	} else {
-		socketFile := path.Join(socketDir, "yubikey-touch-detector.socket")
+		socketFile := unixSocketPath(socketDir)
 
 		if _, err := os.Stat(socketFile); err == nil {
 			log.Warnf("'%v' already exists, assuming it's obsolete and trying to recover", socketFile)
@@ -63,21 +67,46 @@ func SetupUnixSocketNotifier(notifiers *sync.Map, exits *sync.Map) {
 		exit <- true
 	}()
 
-	touch := make(chan Message, 10)
+	touch := make(chan Event, 10)
 	notifiers.Store("notifier/unix_socket", touch)
 
 	touchListeners := make(map[*net.Conn]chan []byte)
 	touchListenersMutex := sync.RWMutex{}
+	keys := make(map[string]Key)
+	keysMutex := sync.Mutex{}
+	listKeys := func() []Key {
+		keysMutex.Lock()
+		defer keysMutex.Unlock()
+		list := []Key{}
+		for _, id := range sortedKeys(keys) {
+			list = append(list, keys[id])
+		}
+		return list
+	}
 	go func() {
 		for {
 			value := <-touch
+			if (value.Message == DEVICE_ON || value.Message == DEVICE_OFF) && value.Key != nil {
+				keysMutex.Lock()
+				if value.Message == DEVICE_ON {
+					keys[value.Key.ID] = *value.Key
+				} else {
+					delete(keys, value.Key.ID)
+				}
+				keysMutex.Unlock()
+			}
+			if value.Update {
+				// The legacy protocol only knows about the beginning and the end of a wait
+				continue
+			}
 			touchListenersMutex.RLock()
 			for _, listener := range touchListeners {
-				listener <- []byte(value)
+				listener <- []byte(value.Message)
 			}
 			touchListenersMutex.RUnlock()
 		}
 	}()
+	go serveUnixSocketDevices(socketDir, listKeys, exits)
 
 	for {
 		listener, err := socket.Accept()
@@ -111,3 +140,88 @@ func unixSocketNotify(listener net.Conn, touchListeners map[*net.Conn]chan []byt
 		}
 	}
 }
+
+func unixSocketPath(socketDir string) string {
+	return path.Join(socketDir, "yubikey-touch-detector.socket")
+}
+
+// The device inventory is served on a socket of its own, so that the events socket only ever transmits 5 bytes long messages
+func unixSocketDevicesPath(socketDir string) string {
+	return path.Join(socketDir, "yubikey-touch-detector.devices.socket")
+}
+
+// serveUnixSocketDevices writes the device inventory as a line of JSON to every client of the devices socket, and hangs up
+func serveUnixSocketDevices(socketDir string, listKeys func() []Key, exits *sync.Map) {
+	socketFile := unixSocketDevicesPath(socketDir)
+	if _, err := os.Stat(socketFile); err == nil {
+		log.Warnf("'%v' already exists, assuming it's obsolete and trying to recover", socketFile)
+		if err = os.Remove(socketFile); err != nil {
+			log.Errorf("Cannot remove '%v' in order to recover from possible previous crash", socketFile)
+			return
+		}
+	}
+
+	socket, err := net.Listen("unix", socketFile)
+	if err != nil {
+		log.Error("Cannot establish the device inventory unix socket listener: ", err)
+		return
+	}
+
+	exit := make(chan bool)
+	exits.Store("notifier/unix_socket_devices", exit)
+	go func() {
+		<-exit
+		if err := socket.Close(); err != nil {
+			log.Error("Cannot cleanup device inventory unix socket: ", err)
+		}
+		exit <- true
+	}()
+
+	for {
+		client, err := socket.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Error("Cannot accept incoming device inventory unix socket connection: ", err)
+			}
+			return
+		}
+
+		reply, err := json.Marshal(listKeys())
+		if err != nil {
+			log.Error("Cannot encode device inventory: ", err)
+			client.Close()
+			continue
+		}
+		if _, err := client.Write(append(reply, '\n')); err != nil {
+			log.Debugf("Cannot send device inventory: %v", err)
+		}
+		client.Close()
+	}
+}
+
+// QueryUnixSocketDevices asks a running detector for its device inventory
+func QueryUnixSocketDevices() ([]Key, error) {
+	socketDir := os.Getenv("XDG_RUNTIME_DIR")
+	if socketDir == "" {
+		return nil, fmt.Errorf("$XDG_RUNTIME_DIR is not defined")
+	}
+
+	conn, err := net.DialTimeout("unix", unixSocketDevicesPath(socketDir), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err := json.Unmarshal(reply, &keys); err != nil {
+		return nil, fmt.Errorf("invalid device inventory: %v", err)
+	}
+	return keys, nil
+}